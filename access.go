@@ -0,0 +1,142 @@
+package imagefilter
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// separator is the path separator of the operating system.
+const separator = string(filepath.Separator)
+
+// provisionAccess makes the static paths of Hide and Deny absolute.
+func (img *ImageFilter) provisionAccess() {
+	for _, patterns := range [][]string{img.Hide, img.Deny} {
+		for i, p := range patterns {
+			if !HasPlaceholder(p) && strings.Contains(p, separator) {
+				if abs, err := filepath.Abs(p); err == nil {
+					patterns[i] = abs
+				}
+			}
+		}
+	}
+}
+
+// checkAccess returns an error with status 404 if the source file is hidden, and an error with
+// status 403 if it's denied or a symbolic link to a file outside of the root (see
+// RestrictSymlinks).
+func (img *ImageFilter) checkAccess(repl *caddy.Replacer, root, filename string) error {
+	if matchPath(filename, replacePaths(repl, img.Hide)) {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("%s is hidden", filename))
+	}
+	if matchPath(filename, replacePaths(repl, img.Deny)) {
+		return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("%s is denied", filename))
+	}
+	if img.RestrictSymlinks {
+		inside, err := insideRoot(root, filename)
+		if err != nil {
+			return caddyhttp.Error(http.StatusNotFound, err)
+		}
+		if !inside {
+			return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("%s links outside of the root", filename))
+		}
+	}
+	return nil
+}
+
+// replacePaths replaces the placeholders of the paths and makes the paths with a separator
+// absolute.
+func replacePaths(repl *caddy.Replacer, paths []string) []string {
+	if len(paths) == 0 {
+		return nil
+	}
+	replaced := make([]string, len(paths))
+	for i, p := range paths {
+		replaced[i] = repl.ReplaceAll(p, "")
+		if strings.Contains(replaced[i], separator) {
+			if abs, err := filepath.Abs(replaced[i]); err == nil {
+				replaced[i] = abs
+			}
+		}
+	}
+	return replaced
+}
+
+// matchPath reports whether the filename matches one of the patterns. It works like the hide
+// subdirective of the file_server: Patterns without a separator are matched against every
+// element of the path, patterns with a separator are matched against the absolute path and as
+// prefix of it.
+func matchPath(filename string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+	if abs, err := filepath.Abs(filename); err == nil {
+		filename = abs
+	}
+
+	var components []string
+	for _, p := range patterns {
+		if !strings.Contains(p, separator) {
+			if components == nil {
+				components = strings.Split(filename, separator)
+			}
+			for _, c := range components {
+				if matched, _ := filepath.Match(p, c); matched {
+					return true
+				}
+			}
+		} else if strings.HasPrefix(filename, p) && strings.HasPrefix(filename[len(p):], separator) {
+			return true
+		}
+		if matched, _ := filepath.Match(p, filename); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// insideRoot reports whether the filename is inside of the root after resolving symbolic links.
+// Only the longest existing part of the filename is resolved, so files inside of archives (see
+// the archive file system) can be checked as well.
+func insideRoot(root, filename string) (bool, error) {
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false, err
+	}
+	resolvedRoot, err = filepath.Abs(resolvedRoot)
+	if err != nil {
+		return false, err
+	}
+
+	existing, rest := filepath.Clean(filename), ""
+	resolved, err := filepath.EvalSymlinks(existing)
+	for errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+		resolved, err = filepath.EvalSymlinks(existing)
+	}
+	if err != nil {
+		return false, err
+	}
+	resolved, err = filepath.Abs(filepath.Join(resolved, rest))
+	if err != nil {
+		return false, err
+	}
+
+	rel, err := filepath.Rel(resolvedRoot, resolved)
+	if err != nil {
+		return false, nil
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+separator), nil
+}
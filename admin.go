@@ -0,0 +1,243 @@
+package imagefilter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminImageFilter{})
+}
+
+// handlers contains all provisioned image filter handlers for introspection through the admin API.
+var handlers = struct {
+	mu     sync.RWMutex
+	nextID uint64
+	list   []*ImageFilter
+}{}
+
+// registerHandler adds a provisioned handler to the list of handlers.
+func registerHandler(img *ImageFilter) {
+	handlers.mu.Lock()
+	defer handlers.mu.Unlock()
+	handlers.nextID++
+	img.id = handlers.nextID
+	handlers.list = append(handlers.list, img)
+}
+
+// unregisterHandler removes a handler from the list of handlers.
+func unregisterHandler(img *ImageFilter) {
+	handlers.mu.Lock()
+	defer handlers.mu.Unlock()
+	for i, h := range handlers.list {
+		if h == img {
+			handlers.list = append(handlers.list[:i], handlers.list[i+1:]...)
+			return
+		}
+	}
+}
+
+// adminImageFilter is a module that provides the /image_filter/ endpoints for the Caddy admin API.
+// They allow to inspect the configured image filter handlers, their current load and cache size,
+// and to purge the caches.
+type adminImageFilter struct{}
+
+// cacheStatus is the size of the cache of source images (see Origin.CacheSize).
+type cacheStatus struct {
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`
+	MaxSize int64 `json:"max_size,omitempty"`
+}
+
+// purgeRequest is the body of a purge request.
+type purgeRequest struct {
+	// Prefix selects the cached source images and the outputs in the variants directories by the
+	// path or URL of their source (or the path of the URL). Empty purges everything.
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// purgeResult is the response of a purge request.
+type purgeResult struct {
+	Sources  int `json:"sources"`
+	Variants int `json:"variants"`
+}
+
+// handlerStatus is the configuration and current load of a handler.
+type handlerStatus struct {
+	ID            uint64            `json:"id"`
+	Root          string            `json:"root"`
+	Pipeline      []json.RawMessage `json:"pipeline"`
+	MaxConcurrent int64             `json:"max_concurrent"`
+	Timeout       caddy.Duration    `json:"timeout,omitempty"`
+	InFlight      int64             `json:"in_flight"`
+	Queued        int64             `json:"queued"`
+	Cache         *cacheStatus      `json:"cache,omitempty"`
+}
+
+// stats is the current load and cache size of all handlers.
+type stats struct {
+	Handlers int         `json:"handlers"`
+	InFlight int64       `json:"in_flight"`
+	Queued   int64       `json:"queued"`
+	Cache    cacheStatus `json:"cache"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (adminImageFilter) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.image_filter",
+		New: func() caddy.Module { return new(adminImageFilter) },
+	}
+}
+
+// Routes returns the routes for the /image_filter/handlers, /image_filter/stats and
+// /image_filter/purge endpoints.
+func (a adminImageFilter) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/image_filter/handlers",
+			Handler: caddy.AdminHandlerFunc(a.handleHandlers),
+		},
+		{
+			Pattern: "/image_filter/stats",
+			Handler: caddy.AdminHandlerFunc(a.handleStats),
+		},
+		{
+			Pattern: "/image_filter/purge",
+			Handler: caddy.AdminHandlerFunc(a.handlePurge),
+		},
+	}
+}
+
+// handleHandlers lists the configured handlers with their pipelines and current load.
+func (adminImageFilter) handleHandlers(w http.ResponseWriter, r *http.Request) error {
+	err := checkMethod(r, http.MethodGet)
+	if err != nil {
+		return err
+	}
+
+	handlers.mu.RLock()
+	results := make([]handlerStatus, 0, len(handlers.list))
+	for _, img := range handlers.list {
+		results = append(results, handlerStatus{
+			ID:            img.id,
+			Root:          img.Root,
+			Pipeline:      img.pipeline,
+			MaxConcurrent: img.MaxConcurrent,
+			Timeout:       img.Timeout,
+			InFlight:      atomic.LoadInt64(&img.inFlight),
+			Queued:        atomic.LoadInt64(&img.queued),
+			Cache:         img.cacheStatus(),
+		})
+	}
+	handlers.mu.RUnlock()
+
+	return writeJSON(w, results)
+}
+
+// handleStats reports the current load and cache size of all handlers.
+func (adminImageFilter) handleStats(w http.ResponseWriter, r *http.Request) error {
+	err := checkMethod(r, http.MethodGet)
+	if err != nil {
+		return err
+	}
+
+	handlers.mu.RLock()
+	result := stats{Handlers: len(handlers.list)}
+	for _, img := range handlers.list {
+		result.InFlight += atomic.LoadInt64(&img.inFlight)
+		result.Queued += atomic.LoadInt64(&img.queued)
+		if cs := img.cacheStatus(); cs != nil {
+			result.Cache.Entries += cs.Entries
+			result.Cache.Size += cs.Size
+			result.Cache.MaxSize += cs.MaxSize
+		}
+	}
+	handlers.mu.RUnlock()
+
+	return writeJSON(w, result)
+}
+
+// handlePurge removes cached source images and the outputs written to the variants directories by
+// prefix or entirely.
+func (adminImageFilter) handlePurge(w http.ResponseWriter, r *http.Request) error {
+	err := checkMethod(r, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	var req purgeRequest
+	if r.Body != nil {
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("decoding request failed: %v", err),
+			}
+		}
+	}
+
+	handlers.mu.RLock()
+	defer handlers.mu.RUnlock()
+	var result purgeResult
+	for _, img := range handlers.list {
+		if img.Origin != nil && img.Origin.cache != nil {
+			result.Sources += img.Origin.cache.purge(req.Prefix)
+		}
+		n, err := img.purgeVariants(req.Prefix)
+		result.Variants += n
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusInternalServerError,
+				Err:        fmt.Errorf("purging variants failed: %v", err),
+			}
+		}
+	}
+
+	return writeJSON(w, result)
+}
+
+// cacheStatus returns the size of the cache of source images, or nil if there is none.
+func (img *ImageFilter) cacheStatus() *cacheStatus {
+	if img.Origin == nil || img.Origin.cache == nil {
+		return nil
+	}
+	entries, size := img.Origin.cache.stats()
+	return &cacheStatus{Entries: entries, Size: size, MaxSize: img.Origin.CacheSize}
+}
+
+// checkMethod only allows requests with the method.
+func checkMethod(r *http.Request, method string) error {
+	if r.Method != method {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	return nil
+}
+
+// writeJSON writes v as JSON response.
+func writeJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("encoding response failed: %v", err),
+		}
+	}
+	return nil
+}
+
+// Interface guards.
+var (
+	_ caddy.AdminRouter = (*adminImageFilter)(nil)
+)
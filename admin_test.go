@@ -0,0 +1,111 @@
+package imagefilter
+
+import (
+	"encoding/json"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestHandlePurge(t *testing.T) {
+	cache := newOriginCache(1 << 20)
+	for _, u := range []string{
+		"https://images.example.com/photos/a.jpg",
+		"https://images.example.com/photos/b.jpg",
+		"https://images.example.com/logos/c.png",
+	} {
+		cache.put(&originEntry{url: u, body: []byte(u)})
+	}
+	variantsDir := t.TempDir()
+	img := newTestImageFilter()
+	img.Origin = &Origin{cache: cache}
+	img.VariantsDir = variantsDir
+	img.Variants = []Variant{{Name: "small", filters: []ContextFilter{testFilter{}}}}
+	// writes the outputs of a source and returns their directory
+	writeVariants := func(source string) string {
+		t.Helper()
+		repl := caddy.NewReplacer()
+		img.setCacheKey(repl, source)
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		_, err := img.variants(r.Context(), r, repl, image.NewRGBA(image.Rect(0, 0, 2, 2)), "png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, _ := repl.GetString("http.image_filter.cache_key")
+		return filepath.Join(variantsDir, key)
+	}
+	photo := writeVariants("/photos/d.jpg")
+	remotePhoto := writeVariants("https://images.example.com/photos/a.jpg")
+	logo := writeVariants("/logos/e.png")
+	// outputs without a recorded source are only removed by purging everything
+	unknown := filepath.Join(variantsDir, strings.Repeat("ab", 32))
+	err := os.MkdirAll(unknown, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Join(variantsDir, "other"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registerHandler(img)
+	defer unregisterHandler(img)
+
+	purge := func(body string) purgeResult {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/image_filter/purge", strings.NewReader(body))
+		err := adminImageFilter{}.handlePurge(w, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result purgeResult
+		err = json.NewDecoder(w.Body).Decode(&result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	if result := purge(`{"prefix": "/photos/"}`); result != (purgeResult{Sources: 2, Variants: 2}) {
+		t.Errorf("purge by prefix = %+v, want 2 sources and 2 variants", result)
+	}
+	if entries, _ := cache.stats(); entries != 1 {
+		t.Errorf("%d entries left, want 1", entries)
+	}
+	for _, dir := range []string{photo, remotePhoto} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("variants of %s were not removed: %v", dir, err)
+		}
+	}
+	for _, dir := range []string{logo, unknown} {
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("variants of another source were removed: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(logo, "small.png")); err != nil {
+		t.Errorf("output of another source was removed: %v", err)
+	}
+
+	if result := purge(""); result != (purgeResult{Sources: 1, Variants: 2}) {
+		t.Errorf("purge all = %+v, want 1 source and 2 variants", result)
+	}
+	if entries, size := cache.stats(); entries != 0 || size != 0 {
+		t.Errorf("cache not empty: %d entries, %d bytes", entries, size)
+	}
+	if _, err := os.Stat(filepath.Join(variantsDir, "other")); err != nil {
+		t.Errorf("unrelated directory was removed: %v", err)
+	}
+
+	err = adminImageFilter{}.handlePurge(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodGet, "/image_filter/purge", nil))
+	if err == nil {
+		t.Error("GET request was allowed")
+	}
+}
@@ -4,6 +4,7 @@ package all
 
 import (
 	_ "github.com/ueffel/caddy-imagefilter/v2/blur"
+	_ "github.com/ueffel/caddy-imagefilter/v2/conditional"
 	_ "github.com/ueffel/caddy-imagefilter/v2/crop"
 	_ "github.com/ueffel/caddy-imagefilter/v2/fit"
 	_ "github.com/ueffel/caddy-imagefilter/v2/flip"
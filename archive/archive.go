@@ -0,0 +1,352 @@
+// Package archive provides a file system module, that serves files from the local disk and from
+// inside of zip archives.
+package archive
+
+import (
+	"archive/zip"
+	"container/list"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// Defaults of Archive.
+var defaultExtensions = []string{".zip", ".cbz"}
+
+const defaultCacheSize = 64
+
+// Archive is a file system, that reads files from the local disk. Paths containing an archive
+// (e.g. "/srv/comics/book.cbz/page001.jpg") address the files inside of the archive. Other paths
+// are read from the local disk as usual. Opened archives are kept open in a cache, so the index of
+// an archive is only read once.
+type Archive struct {
+	// Extensions are the file extensions of archives (case-insensitive). Default is ".zip" and
+	// ".cbz".
+	Extensions []string `json:"extensions,omitempty"`
+
+	// CacheSize is the maximum number of archives, that are kept open. Default is 64.
+	CacheSize int `json:"cache_size,omitempty"`
+
+	logger *zap.Logger
+	cache  *cache
+}
+
+// cache holds the opened archives in least recently used order.
+type cache struct {
+	mu      sync.Mutex
+	lru     *list.List
+	readers map[string]*list.Element
+}
+
+// CaddyModule returns the Caddy module information.
+func (Archive) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.fs.archive",
+		New: func() caddy.Module { return new(Archive) },
+	}
+}
+
+// init registers the file system module.
+func init() {
+	caddy.RegisterModule(Archive{})
+}
+
+// UnmarshalCaddyfile configures the Archive instance.
+//
+// Syntax:
+//
+//	archive {
+//	    extensions <extensions...>
+//	    cache_size <count>
+//	}
+func (a *Archive) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume module name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "extensions":
+			exts := d.RemainingArgs()
+			if len(exts) == 0 {
+				return d.ArgErr()
+			}
+			a.Extensions = append(a.Extensions, exts...)
+
+		case "cache_size":
+			var sizeStr string
+			if !d.AllArgs(&sizeStr) {
+				return d.ArgErr()
+			}
+			size, err := strconv.Atoi(sizeStr)
+			if err != nil {
+				return d.Errf("invalid cache_size: %v", err)
+			}
+			a.CacheSize = size
+
+		default:
+			return d.Errf("unrecognized archive subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// Provision sets the defaults.
+func (a *Archive) Provision(ctx caddy.Context) error {
+	a.logger = ctx.Logger()
+	if len(a.Extensions) == 0 {
+		a.Extensions = append([]string(nil), defaultExtensions...)
+	}
+	for i, ext := range a.Extensions {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		a.Extensions[i] = strings.ToLower(ext)
+	}
+	if a.CacheSize == 0 {
+		a.CacheSize = defaultCacheSize
+	}
+	a.cache = &cache{
+		lru:     list.New(),
+		readers: make(map[string]*list.Element),
+	}
+	return nil
+}
+
+// Validate validates the configuration.
+func (a *Archive) Validate() error {
+	if a.CacheSize < 0 {
+		return errors.New("cache_size must be greater or equal 0")
+	}
+	return nil
+}
+
+// Cleanup closes all cached archives.
+func (a *Archive) Cleanup() error {
+	c := a.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.lru.Len() > 0 {
+		c.removeLocked(c.lru.Back().Value.(*reader))
+	}
+	return nil
+}
+
+// Open opens the named file.
+func (a *Archive) Open(name string) (fs.File, error) {
+	archivePath, inner, ok := a.split(name)
+	if !ok {
+		return os.Open(name)
+	}
+	r, err := a.acquire(archivePath)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	file, err := r.zip.Open(inner)
+	if err != nil {
+		r.release()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: unwrapPathError(err)}
+	}
+	return &archiveFile{File: file, reader: r}, nil
+}
+
+// Stat returns a FileInfo describing the named file.
+func (a *Archive) Stat(name string) (fs.FileInfo, error) {
+	archivePath, inner, ok := a.split(name)
+	if !ok {
+		return os.Stat(name)
+	}
+	r, err := a.acquire(archivePath)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	defer r.release()
+	info, err := fs.Stat(&r.zip.Reader, inner)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: unwrapPathError(err)}
+	}
+	return info, nil
+}
+
+// split splits the name into the path of the archive and the path inside of the archive. The
+// first path element with an archive extension, that is followed by more elements and isn't a
+// directory, is the archive. ok is false, if the name doesn't address a file inside of an archive.
+func (a *Archive) split(name string) (archivePath, inner string, ok bool) {
+	slashed := filepath.ToSlash(name)
+	offset := 0
+	for {
+		i := strings.IndexByte(slashed[offset:], '/')
+		if i < 0 {
+			return "", "", false
+		}
+		end := offset + i
+		if end > 0 && a.isArchive(slashed[:end]) && !isDir(filepath.FromSlash(slashed[:end])) {
+			inner = strings.Trim(slashed[end+1:], "/")
+			if inner == "" {
+				inner = "."
+			}
+			return filepath.FromSlash(slashed[:end]), inner, true
+		}
+		offset = end + 1
+	}
+}
+
+// isArchive reports whether the path has an archive extension.
+func (a *Archive) isArchive(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range a.Extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// isDir reports whether the path is an existing directory.
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// acquire returns the opened archive from the cache or opens it. Archives are opened again, if
+// they were modified since they were opened. The reader has to be released after use.
+func (a *Archive) acquire(path string) (*reader, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+
+	c := a.cache
+	c.mu.Lock()
+	if elem, ok := c.readers[path]; ok {
+		r := elem.Value.(*reader)
+		if r.size == info.Size() && r.modTime.Equal(info.ModTime()) {
+			c.lru.MoveToFront(elem)
+			r.retain()
+			c.mu.Unlock()
+			return r, nil
+		}
+		c.removeLocked(r)
+	}
+	c.mu.Unlock()
+
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &reader{
+		path:    path,
+		zip:     zr,
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		refs:    1,
+		logger:  a.logger,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.readers[path]; ok {
+		// opened concurrently, the newer one replaces the cached one
+		c.removeLocked(elem.Value.(*reader))
+	}
+	r.cached = true
+	r.retain()
+	c.readers[path] = c.lru.PushFront(r)
+	for c.lru.Len() > a.CacheSize {
+		c.removeLocked(c.lru.Back().Value.(*reader))
+	}
+	return r, nil
+}
+
+// removeLocked removes the archive from the cache. It's closed as soon as it isn't used anymore.
+func (c *cache) removeLocked(r *reader) {
+	if elem, ok := c.readers[r.path]; ok && elem.Value == r {
+		c.lru.Remove(elem)
+		delete(c.readers, r.path)
+	}
+	if r.cached {
+		r.cached = false
+		r.release()
+	}
+}
+
+// reader is an opened archive. It's closed when the last reference is released.
+type reader struct {
+	path    string
+	zip     *zip.ReadCloser
+	size    int64
+	modTime time.Time
+	logger  *zap.Logger
+
+	mu     sync.Mutex
+	refs   int
+	cached bool // guarded by cache.mu
+}
+
+// retain adds a reference.
+func (r *reader) retain() {
+	r.mu.Lock()
+	r.refs++
+	r.mu.Unlock()
+}
+
+// release releases a reference and closes the archive, if it was the last one.
+func (r *reader) release() {
+	r.mu.Lock()
+	r.refs--
+	last := r.refs == 0
+	r.mu.Unlock()
+	if last {
+		err := r.zip.Close()
+		if err != nil && r.logger != nil {
+			r.logger.Error("failed to close archive", zap.String("path", r.path), zap.Error(err))
+		}
+	}
+}
+
+// archiveFile is a file inside of an archive. Closing it releases the archive.
+type archiveFile struct {
+	fs.File
+	reader *reader
+	once   sync.Once
+}
+
+// Close closes the file and releases the archive.
+func (f *archiveFile) Close() error {
+	err := f.File.Close()
+	f.once.Do(f.reader.release)
+	return err
+}
+
+// unwrapPathError returns the underlying error of a *fs.PathError, so the error can be wrapped with
+// the full path.
+func unwrapPathError(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	return err
+}
+
+// Interface guards.
+var (
+	_ fs.StatFS             = (*Archive)(nil)
+	_ caddy.Provisioner     = (*Archive)(nil)
+	_ caddy.Validator       = (*Archive)(nil)
+	_ caddy.CleanerUpper    = (*Archive)(nil)
+	_ caddyfile.Unmarshaler = (*Archive)(nil)
+)
@@ -0,0 +1,375 @@
+package archive
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// writeZip writes an archive with the files. It's written to a temporary file first and renamed,
+// so archives that are still open keep their content.
+func writeZip(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(tmp)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.WriteString(w, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = zw.Close()
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeFile writes a file on the local disk.
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte(content), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newArchive returns a provisioned file system, that is cleaned up after the test.
+func newArchive(t *testing.T, cacheSize int) *Archive {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	a := &Archive{CacheSize: cacheSize}
+	err := a.Provision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = a.Cleanup() })
+	return a
+}
+
+// readFile returns the content of the file.
+func readFile(t *testing.T, fsys fs.FS, name string) string {
+	t.Helper()
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// refs returns the number of references of the reader.
+func refs(r *reader) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.refs
+}
+
+// cached returns the cached reader of the archive or nil.
+func cached(a *Archive, path string) *reader {
+	a.cache.mu.Lock()
+	defer a.cache.mu.Unlock()
+	if elem, ok := a.cache.readers[path]; ok {
+		return elem.Value.(*reader)
+	}
+	return nil
+}
+
+func TestSplit(t *testing.T) {
+	base := t.TempDir()
+	// a directory with an archive extension containing an archive
+	writeZip(t, filepath.Join(base, "x.zip", "inner.cbz"), map[string]string{"page.jpg": "page"})
+	writeZip(t, filepath.Join(base, "a.zip"), map[string]string{"b.zip": "b"})
+	a := newArchive(t, 0)
+
+	for _, tc := range []struct {
+		name    string
+		archive string
+		inner   string
+	}{
+		{name: "book.cbz/page.jpg", archive: "book.cbz", inner: "page.jpg"},
+		{name: "book.cbz/chapter/page.jpg", archive: "book.cbz", inner: "chapter/page.jpg"},
+		{name: "comics/2024/book.cbz/page.jpg", archive: "comics/2024/book.cbz", inner: "page.jpg"},
+		{name: "book.cbz/", archive: "book.cbz", inner: "."},
+		{name: "book.cbz//page.jpg/", archive: "book.cbz", inner: "page.jpg"},
+		{name: "BOOK.CBZ/page.jpg", archive: "BOOK.CBZ", inner: "page.jpg"},
+		{name: "Book.Zip/page.jpg", archive: "Book.Zip", inner: "page.jpg"},
+		{name: "x.zip/inner.cbz/page.jpg", archive: "x.zip/inner.cbz", inner: "page.jpg"},
+		{name: "a.zip/b.zip/page.jpg", archive: "a.zip", inner: "b.zip/page.jpg"},
+		{name: "book.cbz"},
+		{name: "x.zip/page.jpg"},
+		{name: "book.cbz.jpg/page.jpg"},
+		{name: "books/page.jpg"},
+	} {
+		// not joined, that would clean the name
+		name := base + "/" + tc.name
+		archivePath, inner, ok := a.split(name)
+		if tc.archive == "" {
+			if ok {
+				t.Errorf("split(%q) = %q, %q, expected no archive", tc.name, archivePath, inner)
+			}
+			continue
+		}
+		want := filepath.Join(base, tc.archive)
+		if !ok || archivePath != want || inner != tc.inner {
+			t.Errorf("split(%q) = %q, %q, %v, want %q, %q", tc.name, archivePath, inner, ok, want, tc.inner)
+		}
+	}
+}
+
+func TestOpenStat(t *testing.T) {
+	base := t.TempDir()
+	book := filepath.Join(base, "comics", "Book.CBZ")
+	writeZip(t, book, map[string]string{
+		"page1.jpg":         "page 1",
+		"chapter/page2.jpg": "page 2",
+	})
+	writeFile(t, filepath.Join(base, "cover.jpg"), "cover")
+	writeFile(t, filepath.Join(base, "x.zip", "page.jpg"), "not archived")
+	a := newArchive(t, 0)
+
+	for name, want := range map[string]string{
+		"comics/Book.CBZ/page1.jpg":         "page 1",
+		"comics/Book.CBZ/chapter/page2.jpg": "page 2",
+		"cover.jpg":                         "cover",
+		"x.zip/page.jpg":                    "not archived",
+	} {
+		name := filepath.Join(base, name)
+		if got := readFile(t, a, name); got != want {
+			t.Errorf("%s: content = %q, want %q", name, got, want)
+		}
+		info, err := a.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.IsDir() || info.Size() != int64(len(want)) || info.Name() != filepath.Base(name) {
+			t.Errorf("%s: stat = %s, %d bytes, dir %v", name, info.Name(), info.Size(), info.IsDir())
+		}
+	}
+
+	info, err := a.Stat(filepath.Join(book, "chapter"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() {
+		t.Error("directory inside of the archive is not a directory")
+	}
+
+	for _, name := range []string{
+		filepath.Join(book, "missing.jpg"),
+		filepath.Join(base, "missing.cbz", "page1.jpg"),
+		filepath.Join(base, "missing.jpg"),
+	} {
+		_, err := a.Open(name)
+		var pathErr *fs.PathError
+		if !errors.Is(err, fs.ErrNotExist) || !errors.As(err, &pathErr) || pathErr.Path != name {
+			t.Errorf("open %s: %v, want not exist error with the full path", name, err)
+		}
+		_, err = a.Stat(name)
+		if !errors.Is(err, fs.ErrNotExist) || !errors.As(err, &pathErr) || pathErr.Path != name {
+			t.Errorf("stat %s: %v, want not exist error with the full path", name, err)
+		}
+	}
+
+	// only the cache holds a reference after all files are closed, also after errors
+	r := cached(a, book)
+	if r == nil {
+		t.Fatal("archive is not cached")
+	}
+	if n := refs(r); n != 1 {
+		t.Errorf("archive has %d references, want 1", n)
+	}
+}
+
+func TestReopenModified(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "book.zip")
+	writeZip(t, path, map[string]string{"page.txt": "v1"})
+	a := newArchive(t, 0)
+	name := filepath.Join(path, "page.txt")
+
+	old, err := a.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldReader := old.(*archiveFile).reader
+
+	writeZip(t, path, map[string]string{"page.txt": "v2"})
+	// the modification time alone identifies the change, the size is the same
+	modTime := time.Now().Add(time.Hour)
+	err = os.Chtimes(path, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFile(t, a, name); got != "v2" {
+		t.Errorf("content after modification = %q, want %q", got, "v2")
+	}
+	if cached(a, path) == oldReader {
+		t.Error("modified archive was not opened again")
+	}
+
+	// the replaced archive stays open until its last file is closed
+	data, err := io.ReadAll(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "v1" {
+		t.Errorf("content of the file opened before = %q, want %q", data, "v1")
+	}
+	if n := refs(oldReader); n != 1 {
+		t.Errorf("replaced archive has %d references, want 1", n)
+	}
+	err = old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := refs(oldReader); n != 0 {
+		t.Errorf("replaced archive has %d references after close, want 0", n)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	base := t.TempDir()
+	first := filepath.Join(base, "first.zip")
+	second := filepath.Join(base, "second.zip")
+	writeZip(t, first, map[string]string{"page.txt": "first"})
+	writeZip(t, second, map[string]string{"page.txt": "second"})
+	a := newArchive(t, 1)
+
+	f, err := a.Open(filepath.Join(first, "page.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstReader := f.(*archiveFile).reader
+
+	if got := readFile(t, a, filepath.Join(second, "page.txt")); got != "second" {
+		t.Errorf("content = %q, want %q", got, "second")
+	}
+	if cached(a, first) != nil || cached(a, second) == nil {
+		t.Error("least recently used archive was not evicted")
+	}
+	if a.cache.lru.Len() != 1 {
+		t.Errorf("%d archives cached, want 1", a.cache.lru.Len())
+	}
+
+	// the evicted archive stays open until its last file is closed
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "first" {
+		t.Errorf("content of the evicted archive = %q, want %q", data, "first")
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// closing twice releases only once
+	_ = f.Close()
+	if n := refs(firstReader); n != 0 {
+		t.Errorf("evicted archive has %d references after close, want 0", n)
+	}
+
+	secondReader := cached(a, second)
+	err = a.Cleanup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := refs(secondReader); n != 0 {
+		t.Errorf("cached archive has %d references after cleanup, want 0", n)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	base := t.TempDir()
+	var paths []string
+	for i := 0; i < 4; i++ {
+		path := filepath.Join(base, fmt.Sprintf("book%d.zip", i))
+		writeZip(t, path, map[string]string{"page.txt": path})
+		paths = append(paths, path)
+	}
+	a := newArchive(t, 2)
+
+	var mu sync.Mutex
+	readers := make(map[*reader]bool)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				path := paths[(g+i)%len(paths)]
+				name := filepath.Join(path, "page.txt")
+				if _, err := a.Stat(name); err != nil {
+					t.Error(err)
+					return
+				}
+				f, err := a.Open(name)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				readers[f.(*archiveFile).reader] = true
+				mu.Unlock()
+				data, err := io.ReadAll(f)
+				if err != nil || string(data) != path {
+					t.Errorf("%s: content = %q, %v", name, data, err)
+				}
+				err = f.Close()
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if n := a.cache.lru.Len(); n > 2 {
+		t.Errorf("%d archives cached, want at most 2", n)
+	}
+	err := a.Cleanup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for r := range readers {
+		if n := refs(r); n != 0 {
+			t.Errorf("archive %s has %d references after cleanup, want 0", r.path, n)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package imagefilter
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// defaultFallbackMaxAge is the max-age of responses with the original image or where a filter
+// failed, if CacheControl.FallbackMaxAge is not set.
+const defaultFallbackMaxAge = caddy.Duration(time.Minute)
+
+// CacheControl determines the Cache-Control header of responses.
+type CacheControl struct {
+	// MaxAge is the time, the response can be cached.
+	MaxAge caddy.Duration `json:"max_age,omitempty"`
+
+	// Immutable marks the response as immutable, e.g. for signed or versioned URLs.
+	Immutable bool `json:"immutable,omitempty"`
+
+	// StaleWhileRevalidate is the time, a stale response can be used while it's revalidated in the
+	// background.
+	StaleWhileRevalidate caddy.Duration `json:"stale_while_revalidate,omitempty"`
+
+	// FallbackMaxAge is the max-age of responses that didn't get all filters applied, either
+	// because the original image is served after a timeout (see ImageFilter.OnTimeout) or because a
+	// filter failed. Those responses are never marked immutable or stale-while-revalidate. Default
+	// is 1 minute or MaxAge if it's less.
+	FallbackMaxAge caddy.Duration `json:"fallback_max_age,omitempty"`
+}
+
+// unmarshalCacheControl parses the cache_control block.
+//
+// Syntax:
+//
+//	cache_control {
+//	    max_age                <duration>
+//	    immutable
+//	    stale_while_revalidate <duration>
+//	    fallback_max_age       <duration>
+//	}
+func unmarshalCacheControl(d *caddyfile.Dispenser) (*CacheControl, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	cc := new(CacheControl)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "max_age", "stale_while_revalidate", "fallback_max_age":
+			name := d.Val()
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid %s: %v", name, err)
+			}
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			switch name {
+			case "max_age":
+				cc.MaxAge = caddy.Duration(dur)
+			case "stale_while_revalidate":
+				cc.StaleWhileRevalidate = caddy.Duration(dur)
+			case "fallback_max_age":
+				cc.FallbackMaxAge = caddy.Duration(dur)
+			}
+
+		case "immutable":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			cc.Immutable = true
+
+		default:
+			return nil, d.Errf("unrecognized cache_control subdirective '%s'", d.Val())
+		}
+	}
+	return cc, nil
+}
+
+// provision sets the defaults.
+func (cc *CacheControl) provision() {
+	if cc.FallbackMaxAge == 0 {
+		cc.FallbackMaxAge = min(defaultFallbackMaxAge, cc.MaxAge)
+	}
+}
+
+// validate validates the configuration.
+func (cc *CacheControl) validate() error {
+	if cc.MaxAge < 0 || cc.StaleWhileRevalidate < 0 || cc.FallbackMaxAge < 0 {
+		return errors.New("cache_control durations must be greater or equal 0")
+	}
+	return nil
+}
+
+// setHeader sets the Cache-Control header. A fallback response gets the lower FallbackMaxAge and
+// is never immutable.
+func (cc *CacheControl) setHeader(w http.ResponseWriter, fallback bool) {
+	if fallback {
+		w.Header().Set("Cache-Control", "max-age="+seconds(cc.FallbackMaxAge))
+		return
+	}
+
+	directives := []string{"max-age=" + seconds(cc.MaxAge)}
+	if cc.Immutable {
+		directives = append(directives, "immutable")
+	}
+	if cc.StaleWhileRevalidate > 0 {
+		directives = append(directives, "stale-while-revalidate="+seconds(cc.StaleWhileRevalidate))
+	}
+	w.Header().Set("Cache-Control", strings.Join(directives, ", "))
+}
+
+// seconds formats a duration in whole seconds.
+func seconds(d caddy.Duration) string {
+	return strconv.FormatInt(int64(time.Duration(d)/time.Second), 10)
+}
+
+// setCacheControl sets the Cache-Control header, if it's configured. Responses with the original
+// image or where a filter failed are fallback responses.
+func (img *ImageFilter) setCacheControl(w http.ResponseWriter, repl *caddy.Replacer, original bool) {
+	if img.CacheControl == nil {
+		return
+	}
+	if original {
+		// the result of the worker is discarded, so its filter errors don't matter
+		img.CacheControl.setHeader(w, true)
+		return
+	}
+	filterErrors, _ := repl.Get("http.image_filter.filter_errors")
+	failed, _ := filterErrors.(int)
+	img.CacheControl.setHeader(w, failed > 0)
+}
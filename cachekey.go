@@ -0,0 +1,73 @@
+package imagefilter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// sourceKey is the placeholder key of the source of the response, the path of a file or the URL
+// of an origin. It's set together with {http.image_filter.cache_key}.
+const sourceKey = "image_filter.source"
+
+// setCacheKey sets {http.image_filter.cache_key} and the source of the response (see cacheKey).
+func (img *ImageFilter) setCacheKey(repl *caddy.Replacer, path string, identity ...string) {
+	repl.Set(sourceKey, path)
+	repl.Set("http.image_filter.cache_key", img.cacheKey(repl, path, identity...))
+}
+
+// matchSourcePrefix reports whether the source starts with the prefix. URLs also match, if their
+// path starts with the prefix. An empty prefix matches everything.
+func matchSourcePrefix(source, prefix string) bool {
+	if prefix == "" || strings.HasPrefix(source, prefix) {
+		return true
+	}
+	u, err := url.Parse(source)
+	return err == nil && u.Host != "" && strings.HasPrefix(u.Path, prefix)
+}
+
+// cacheKey returns a key that identifies the response for a source image. It's built from the
+// path and the identity of the source (e.g. size and modification time of a file), the pipeline
+// with all known placeholders replaced and the encoding options. Placeholders that are only known
+// after decoding (like {image_filter.width}) are kept as they are, because their values are
+// determined by the source image.
+func (img *ImageFilter) cacheKey(repl *caddy.Replacer, path string, identity ...string) string {
+	h := sha256.New()
+	write := func(s string) {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+
+	write(path)
+	for _, id := range identity {
+		write(id)
+	}
+	for _, filter := range img.pipeline {
+		write(repl.ReplaceKnown(string(filter), ""))
+	}
+	for _, v := range img.Variants {
+		write(v.Name)
+		for _, filter := range v.pipeline {
+			write(repl.ReplaceKnown(string(filter), ""))
+		}
+	}
+	write(img.VariantsDir)
+	write(strconv.Itoa(img.JpegQuality))
+	write(strconv.Itoa(img.PngCompression))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// setSurrogateKeys adds Surrogate-Key and Cache-Tag headers naming the source file, so caches can
+// purge all responses of a source file at once.
+func setSurrogateKeys(w http.ResponseWriter, path string) {
+	// keys are separated by spaces (Surrogate-Key) or commas (Cache-Tag)
+	key := strings.ReplaceAll((&url.URL{Path: path}).EscapedPath(), ",", "%2C")
+	w.Header().Add("Surrogate-Key", key)
+	w.Header().Add("Cache-Tag", key)
+}
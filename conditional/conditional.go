@@ -0,0 +1,149 @@
+package conditional
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	imagefilter "github.com/ueffel/caddy-imagefilter/v2"
+	"go.uber.org/zap"
+)
+
+// If applies image filters only if a CEL expression evaluates to true. The expression is evaluated
+// per request like caddy's expression matcher, so placeholders can be used. Additionally to the
+// request placeholders the following are available:
+//
+//	{image_filter.width}          width of the current image
+//	{image_filter.height}         height of the current image
+//	{image_filter.source_width}   width of the source image
+//	{image_filter.source_height}  height of the source image
+//	{image_filter.format}         format of the source image (jpeg, png, gif, ...)
+type If struct {
+	// Expression is the CEL expression that determines if the filters are applied.
+	Expression string `json:"expression,omitempty"`
+
+	// Pipeline is the ordered list of image filters, that are applied if the expression is true.
+	PipelineRaw []json.RawMessage `json:"pipeline,omitempty" caddy:"namespace=http.handlers.image_filter.filter inline_key=filter"`
+
+	matcher *caddyhttp.MatchExpression
+	filters []imagefilter.ContextFilter
+	logger  *zap.Logger
+}
+
+// UnmarshalCaddyfile configures the If instance.
+//
+// Syntax:
+//
+//	if <expression> {
+//	    <filters...> <filter-args...>
+//	}
+//
+// Parameters:
+//
+// expression is a CEL expression (see https://caddyserver.com/docs/caddyfile/matchers#expression),
+// it should be in backticks or quotes if it contains spaces.
+//
+// filters is a list of filters with their corresponding arguments, that are applied in order of
+// definition, if the expression evaluates to true.
+func (f *If) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	args := d.RemainingArgsRaw()
+	if len(args) == 0 {
+		return imagefilter.ErrTooFewArgs
+	}
+	if len(args) > 1 {
+		f.Expression = strings.Join(args, " ")
+	} else {
+		f.Expression = d.Val()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		filter, err := imagefilter.UnmarshalFilter(d)
+		if err != nil {
+			return err
+		}
+		f.PipelineRaw = append(f.PipelineRaw, filter)
+	}
+
+	return nil
+}
+
+// Provision compiles the expression and loads the image filters.
+func (f *If) Provision(ctx caddy.Context) error {
+	f.logger = ctx.Logger()
+
+	f.matcher = &caddyhttp.MatchExpression{Expr: f.Expression}
+	err := f.matcher.Provision(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(f.PipelineRaw) > 0 {
+		f.filters, err = imagefilter.LoadPipeline(ctx, f, "PipelineRaw")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate validates the configuration.
+func (f *If) Validate() error {
+	if f.Expression == "" {
+		return errors.New("no expression configured")
+	}
+	if len(f.filters) == 0 {
+		return errors.New("no image filters to apply configured")
+	}
+	return nil
+}
+
+// ApplyContext applies the image filters to an image if the expression is true and returns the new
+// image.
+func (f *If) ApplyContext(ctx context.Context, r *http.Request, repl *caddy.Replacer, img image.Image) (image.Image, error) {
+	if !f.match(ctx, r, repl) {
+		return img, nil
+	}
+	return imagefilter.ApplyFilters(ctx, r, repl, f.filters, img, f.logger)
+}
+
+// match evaluates the expression. The matcher takes the replacer from the request's context, which
+// is not the replacer of the pipeline, if the image is filtered in the background (see
+// ImageFilter.Timeout). Without a request (see imagefilter.ApplyFilters) an empty GET request is
+// used.
+func (f *If) match(ctx context.Context, r *http.Request, repl *caddy.Replacer) bool {
+	if r == nil {
+		var err error
+		r, err = http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+		if err != nil {
+			return false
+		}
+	}
+	return f.matcher.Match(r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl)))
+}
+
+// CaddyModule returns the Caddy module information.
+func (If) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.image_filter.filter.if",
+		New: func() caddy.Module { return new(If) },
+	}
+}
+
+// init registers the image filter.
+func init() {
+	caddy.RegisterModule(If{})
+}
+
+// Interface guards.
+var (
+	_ imagefilter.ContextFilter = (*If)(nil)
+	_ caddyfile.Unmarshaler     = (*If)(nil)
+	_ caddy.Provisioner         = (*If)(nil)
+	_ caddy.Validator           = (*If)(nil)
+)
@@ -0,0 +1,172 @@
+package conditional
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	imagefilter "github.com/ueffel/caddy-imagefilter/v2"
+	"github.com/ueffel/caddy-imagefilter/v2/resize"
+	"go.uber.org/zap"
+)
+
+// newContext returns a caddy context for provisioning modules.
+func newContext(t *testing.T) caddy.Context {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// newResize returns a provisioned resize filter.
+func newResize(t *testing.T, width string) imagefilter.ContextFilter {
+	t.Helper()
+	f := &resize.Resize{Width: width}
+	err := f.Provision(newContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// newIf returns a provisioned If with a resize filter. The filters are set directly, so the
+// test doesn't depend on loading modules.
+func newIf(t *testing.T, expression, width string) *If {
+	t.Helper()
+	f := &If{
+		Expression: expression,
+		matcher:    &caddyhttp.MatchExpression{Expr: expression},
+		filters:    []imagefilter.ContextFilter{newResize(t, width)},
+		logger:     zap.NewNop(),
+	}
+	err := f.matcher.Provision(newContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// newReplacer returns a replacer with the dimension placeholders of the image.
+func newReplacer(img image.Image) *caddy.Replacer {
+	repl := caddy.NewReplacer()
+	repl.Set("image_filter.width", img.Bounds().Dx())
+	repl.Set("image_filter.height", img.Bounds().Dy())
+	return repl
+}
+
+func TestIf(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	r := httptest.NewRequest(http.MethodGet, "/test.png", nil)
+	for _, tc := range []struct {
+		expression string
+		r          *http.Request
+		width      int
+	}{
+		{expression: "{image_filter.width} > 50", r: r, width: 20},
+		{expression: "{image_filter.width} > 500", r: r, width: 100},
+		{expression: "{image_filter.height} == 50", r: r, width: 20},
+		{expression: "{image_filter.height} != 50", r: r, width: 100},
+		{expression: "{image_filter.width} > 50", width: 20},
+	} {
+		f := newIf(t, tc.expression, "20")
+		// the replacer of the request must not be used
+		r := tc.r
+		if r != nil {
+			r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		}
+		result, err := f.ApplyContext(context.Background(), r, newReplacer(src), src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := result.Bounds().Dx(); got != tc.width {
+			t.Errorf("%s (request %v): width = %d, want %d", tc.expression, tc.r != nil, got, tc.width)
+		}
+	}
+}
+
+func TestIfPlaceholdersOfPipeline(t *testing.T) {
+	filters := []imagefilter.ContextFilter{
+		newResize(t, "60"),
+		newIf(t, "{image_filter.width} < 70", "30"),
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	result, err := imagefilter.ApplyFilters(context.Background(), nil, newReplacer(src), filters, src, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := result.Bounds().Dx(); got != 30 {
+		t.Errorf("width = %d, want 30", got)
+	}
+}
+
+// skipWithoutModuleLoading skips the test, if caddy can't load modules of []json.RawMessage fields.
+// With newer Go versions json.RawMessage is an alias of another type, which caddy doesn't
+// recognize.
+func skipWithoutModuleLoading(t *testing.T) {
+	t.Helper()
+	if typ := reflect.TypeOf(json.RawMessage{}); typ.PkgPath() != "encoding/json" || typ.Name() != "RawMessage" {
+		t.Skipf("caddy can't load modules with %s, json.RawMessage is %s", runtime.Version(), typ)
+	}
+}
+
+func TestIfBuffered(t *testing.T) {
+	skipWithoutModuleLoading(t)
+	root := t.TempDir()
+	buf := new(bytes.Buffer)
+	err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 100, 50)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(root, "test.png"), buf.Bytes(), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		h := &imagefilter.ImageFilter{
+			Root: root,
+			PipelineRaw: []json.RawMessage{
+				json.RawMessage(`{"filter": "if", "expression": "{image_filter.width} > 50", "pipeline": [{"filter": "resize", "width": "20"}]}`),
+			},
+			Timeout: caddy.Duration(timeout),
+		}
+		err = h.Provision(newContext(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = h.Validate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		repl := caddy.NewReplacer()
+		r := httptest.NewRequest(http.MethodGet, "/test.png", nil)
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+		w := httptest.NewRecorder()
+		err = h.ServeHTTP(w, r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := repl.Get("http.image_filter.output_width"); got != 20 {
+			t.Errorf("timeout %v: output_width = %v, want 20", timeout, got)
+		}
+		_ = h.Cleanup()
+	}
+}
@@ -1,14 +1,14 @@
 package crop
 
 import (
-	"fmt"
 	"image"
-	"strconv"
+	"strings"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/disintegration/imaging"
 	imagefilter "github.com/ueffel/caddy-imagefilter/v2"
+	"github.com/ueffel/caddy-imagefilter/v2/params"
 )
 
 // Crop produces a cropped image as rectangular region of a specific size.
@@ -16,6 +16,9 @@ type Crop struct {
 	Width  string `json:"width,omitempty"`
 	Height string `json:"height,omitempty"`
 	Anchor string `json:"anchor,omitempty"`
+
+	size   params.Size
+	anchor params.Anchor
 }
 
 // UnmarshalCaddyfile configures Crop instance.
@@ -23,6 +26,7 @@ type Crop struct {
 // Syntax:
 //
 //	crop <width> <height> [<anchor>]
+//	crop <aspect ratio> [<anchor>]
 //
 // Parameters:
 //
@@ -30,11 +34,16 @@ type Crop struct {
 //
 // height must be a positive integer and determines the height of the cropped image.
 //
+// Width and height can also be percentages of the image size like 50%.
+//
+// aspect ratio in the form <w>:<h> (e.g. 16:9) crops the largest region with this aspect ratio.
+//
 // anchor determines the anchor point of the rectangular region that is cut out. Possible values
 // are: center, topleft, top, topright, left, right, bottomleft, bottom, bottomright.
-// Default is center.
+// Default is center, or the focal point and manual crop region of the image's sidecar (see
+// imagefilter.CropHints).
 func (f *Crop) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	if d.CountRemainingArgs() < 2 {
+	if d.CountRemainingArgs() < 1 {
 		return imagefilter.ErrTooFewArgs
 	}
 	if d.CountRemainingArgs() > 3 {
@@ -43,60 +52,57 @@ func (f *Crop) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 	args := d.RemainingArgs()
 	f.Width = args[0]
-	f.Height = args[1]
+	if strings.Contains(args[0], ":") {
+		if len(args) > 2 {
+			return imagefilter.ErrTooManyArgs
+		}
+		if len(args) > 1 {
+			f.Anchor = args[1]
+		}
+		return nil
+	}
 
-	if len(args) < 3 {
-		f.Anchor = "center"
-	} else {
+	if len(args) < 2 {
+		return imagefilter.ErrTooFewArgs
+	}
+	f.Height = args[1]
+	if len(args) > 2 {
 		f.Anchor = args[2]
 	}
 
 	return nil
 }
 
-// Apply applies the image filter to an image and returns the new image.
-func (f *Crop) Apply(repl *caddy.Replacer, img image.Image) (image.Image, error) {
-	widthRepl := repl.ReplaceAll(f.Width, "")
-	width, err := strconv.Atoi(widthRepl)
+// Provision parses the arguments.
+func (f *Crop) Provision(ctx caddy.Context) error {
+	var err error
+	f.size, err = params.NewSize(f.Width, f.Height, params.SizeOptions{AspectRatio: true})
 	if err != nil {
-		return img, fmt.Errorf("invalid width %s %w", widthRepl, err)
+		return err
 	}
-	if width <= 0 {
-		return nil, fmt.Errorf("invalid width %d", width)
+	f.anchor, err = params.NewAnchor("anchor", f.Anchor)
+	return err
+}
+
+// Apply applies the image filter to an image and returns the new image.
+func (f *Crop) Apply(repl *caddy.Replacer, img image.Image) (image.Image, error) {
+	if f.Anchor == "" {
+		if region, focal, ok := imagefilter.CropHints(repl, img.Bounds()); ok {
+			width, height, err := f.size.Resolve(repl, region)
+			if err != nil {
+				return img, err
+			}
+			return imaging.Crop(img, imagefilter.FocusRect(region, focal, width, height)), nil
+		}
 	}
 
-	heightRepl := repl.ReplaceAll(f.Height, "")
-	height, err := strconv.Atoi(heightRepl)
+	width, height, err := f.size.Resolve(repl, img.Bounds())
 	if err != nil {
-		return img, fmt.Errorf("invalid height %s %w", heightRepl, err)
-	}
-	if height <= 0 {
-		return img, fmt.Errorf("invalid height %d", height)
+		return img, err
 	}
-
-	var anchor imaging.Anchor
-	anchorRepl := repl.ReplaceAll(f.Anchor, "")
-	switch anchorRepl {
-	case "center":
-		anchor = imaging.Center
-	case "topleft":
-		anchor = imaging.TopLeft
-	case "top":
-		anchor = imaging.Top
-	case "topright":
-		anchor = imaging.TopRight
-	case "left":
-		anchor = imaging.Left
-	case "right":
-		anchor = imaging.Right
-	case "bottomleft":
-		anchor = imaging.BottomLeft
-	case "bottom":
-		anchor = imaging.Bottom
-	case "bottomright":
-		anchor = imaging.BottomRight
-	default:
-		return nil, fmt.Errorf("invalid anchor '%s'", anchorRepl)
+	anchor, err := f.anchor.Value(repl)
+	if err != nil {
+		return img, err
 	}
 
 	return imaging.CropAnchor(img, width, height, anchor), nil
@@ -119,4 +125,5 @@ func init() {
 var (
 	_ imagefilter.Filter    = (*Crop)(nil)
 	_ caddyfile.Unmarshaler = (*Crop)(nil)
+	_ caddy.Provisioner     = (*Crop)(nil)
 )
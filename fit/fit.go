@@ -1,14 +1,13 @@
 package fit
 
 import (
-	"fmt"
 	"image"
-	"strconv"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/disintegration/imaging"
 	imagefilter "github.com/ueffel/caddy-imagefilter/v2"
+	"github.com/ueffel/caddy-imagefilter/v2/params"
 )
 
 // Fit scales a image to fit to the specified maximum width and height using a linear filter, the
@@ -17,6 +16,8 @@ import (
 type Fit struct {
 	Width  string `json:"width,omitempty"`
 	Height string `json:"height,omitempty"`
+
+	size params.Size
 }
 
 // UnmarshalCaddyfile configures the Fit instance.
@@ -24,14 +25,19 @@ type Fit struct {
 // Syntax:
 //
 //	fit <width> <height>
+//	fit <megapixels>mp
 //
 // Parameters:
 //
 // width must be a positive integer and determines the maximum width.
 //
 // height must be a positive integer and determines the maximum height.
+//
+// Width and height can also be percentages of the image size like 50%.
+//
+// megapixels is the maximum number of pixels of the scaled image in millions (e.g. 2mp).
 func (f *Fit) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	if d.CountRemainingArgs() < 2 {
+	if d.CountRemainingArgs() < 1 {
 		return imagefilter.ErrTooFewArgs
 	}
 	if d.CountRemainingArgs() > 2 {
@@ -40,37 +46,25 @@ func (f *Fit) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 	args := d.RemainingArgs()
 	f.Width = args[0]
-	f.Height = args[1]
+	if len(args) > 1 {
+		f.Height = args[1]
+	}
 
 	return nil
 }
 
-// Apply applies the image filter to an image and returns the new image.
-func (f *Fit) Apply(repl *caddy.Replacer, img image.Image) (image.Image, error) {
+// Provision parses the arguments.
+func (f *Fit) Provision(ctx caddy.Context) error {
 	var err error
-	var width int
-	widthRepl := repl.ReplaceAll(f.Width, "")
-	if widthRepl == "" {
-		width = 0
-	} else {
-		width, err = strconv.Atoi(widthRepl)
-		if err != nil {
-			return img, fmt.Errorf("invalid width: %w", err)
-		}
-	}
-	var height int
-	heightRepl := repl.ReplaceAll(f.Height, "")
-	if heightRepl == "" {
-		height = 0
-	} else {
-		height, err = strconv.Atoi(heightRepl)
-		if err != nil {
-			return img, fmt.Errorf("invalid height: %w", err)
-		}
-	}
+	f.size, err = params.NewSize(f.Width, f.Height, params.SizeOptions{Megapixels: true})
+	return err
+}
 
-	if height <= 0 || width <= 0 {
-		return img, fmt.Errorf("invalid width height combination %d %d", width, height)
+// Apply applies the image filter to an image and returns the new image.
+func (f *Fit) Apply(repl *caddy.Replacer, img image.Image) (image.Image, error) {
+	width, height, err := f.size.Resolve(repl, img.Bounds())
+	if err != nil {
+		return img, err
 	}
 
 	return imaging.Fit(img, width, height, imaging.Linear), nil
@@ -93,4 +87,5 @@ func init() {
 var (
 	_ imagefilter.Filter    = (*Fit)(nil)
 	_ caddyfile.Unmarshaler = (*Fit)(nil)
+	_ caddy.Provisioner     = (*Fit)(nil)
 )
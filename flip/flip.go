@@ -37,6 +37,14 @@ func (f *Flip) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// Validate validates the arguments that contain no placeholders.
+func (f *Flip) Validate() error {
+	if !imagefilter.HasPlaceholder(f.Direction) {
+		return validateDirection(f.Direction)
+	}
+	return nil
+}
+
 // Apply applies the image filter to an image and returns the new image.
 func (f *Flip) Apply(repl *caddy.Replacer, img image.Image) (image.Image, error) {
 	direction := repl.ReplaceAll(f.Direction, "")
@@ -47,10 +55,18 @@ func (f *Flip) Apply(repl *caddy.Replacer, img image.Image) (image.Image, error)
 	case "v":
 		return imaging.FlipV(img), nil
 	default:
-		return nil, fmt.Errorf("unknown flip direction %s", direction)
+		return img, validateDirection(direction)
 	}
 }
 
+// validateDirection checks if the direction is one of the supported values.
+func validateDirection(direction string) error {
+	if direction != "h" && direction != "v" {
+		return fmt.Errorf("unknown flip direction %s", direction)
+	}
+	return nil
+}
+
 // CaddyModule returns the Caddy module information.
 func (Flip) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
@@ -68,4 +84,5 @@ func init() {
 var (
 	_ imagefilter.Filter    = (*Flip)(nil)
 	_ caddyfile.Unmarshaler = (*Flip)(nil)
+	_ caddy.Validator       = (*Flip)(nil)
 )
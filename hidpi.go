@@ -0,0 +1,167 @@
+package imagefilter
+
+import (
+	"context"
+	"errors"
+	"image"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// defaultHiDPISuffixes are the default of HiDPI.Suffixes.
+var defaultHiDPISuffixes = []string{"@2x", "@3x"}
+
+// HiDPI selects the source file from pre-rendered high density variants like "hero@2x.jpg" and
+// "hero@3x.jpg", if the source file is smaller than the target size. The smallest variant, that
+// is at least the target size, is used, or the largest variant if none is large enough. Only the
+// headers of the files are read to determine their size.
+type HiDPI struct {
+	// Width is the target width in pixels. It can contain placeholders, e.g. "{query.w}". Empty or
+	// 0 means any width is sufficient.
+	Width string `json:"width,omitempty"`
+
+	// Height is the target height in pixels. It can contain placeholders. Empty or 0 means any
+	// height is sufficient.
+	Height string `json:"height,omitempty"`
+
+	// Suffixes are appended to the file name (before the extension) to get the variants. They
+	// have to be ordered from smallest to largest variant. Default is "@2x" and "@3x".
+	Suffixes []string `json:"suffixes,omitempty"`
+}
+
+// unmarshalHiDPI parses the hidpi subdirective.
+//
+// Syntax:
+//
+//	hidpi <width> [<height>] {
+//	    suffixes <suffixes...>
+//	}
+func unmarshalHiDPI(d *caddyfile.Dispenser) (*HiDPI, error) {
+	hd := new(HiDPI)
+	args := d.RemainingArgs()
+	switch len(args) {
+	case 2:
+		hd.Height = args[1]
+		fallthrough
+	case 1:
+		hd.Width = args[0]
+	default:
+		return nil, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "suffixes":
+			suffixes := d.RemainingArgs()
+			if len(suffixes) == 0 {
+				return nil, d.ArgErr()
+			}
+			hd.Suffixes = append(hd.Suffixes, suffixes...)
+
+		default:
+			return nil, d.Errf("unrecognized hidpi subdirective '%s'", d.Val())
+		}
+	}
+	return hd, nil
+}
+
+// provision sets the defaults.
+func (hd *HiDPI) provision() {
+	if len(hd.Suffixes) == 0 {
+		hd.Suffixes = defaultHiDPISuffixes
+	}
+}
+
+// validate validates the configuration.
+func (hd *HiDPI) validate() error {
+	if hd.Width == "" && hd.Height == "" {
+		return errors.New("hidpi requires a target width or height")
+	}
+	for _, suffix := range hd.Suffixes {
+		if suffix == "" || strings.ContainsAny(suffix, `/\`) {
+			return errors.New("hidpi suffixes must not be empty or contain path separators")
+		}
+	}
+	return nil
+}
+
+// target returns the target size with placeholders replaced. Invalid values are 0.
+func (hd *HiDPI) target(repl *caddy.Replacer) (int, int) {
+	parse := func(arg string) int {
+		v, err := strconv.Atoi(strings.TrimSpace(repl.ReplaceAll(arg, "")))
+		if err != nil || v < 0 {
+			return 0
+		}
+		return v
+	}
+	return parse(hd.Width), parse(hd.Height)
+}
+
+// selectDensity returns the source file to use for the target size. file is the opened source
+// file, it's closed if another file is selected. The returned file is always open.
+func (img *ImageFilter) selectDensity(ctx context.Context, repl *caddy.Replacer, root, filename string, file fs.File, info fs.FileInfo) (string, fs.File, fs.FileInfo, error) {
+	width, height := img.HiDPI.target(repl)
+	if width == 0 && height == 0 {
+		return filename, file, info, nil
+	}
+	sufficient := func(cfg image.Config) bool {
+		return cfg.Width >= width && cfg.Height >= height
+	}
+
+	cfg, _, err := image.DecodeConfig(file)
+	file.Close()
+	if err != nil {
+		// decoding errors are reported when the file is decoded completely
+		file, info, err = img.open(ctx, filename)
+		return filename, file, info, err
+	}
+
+	selected, selectedPixels := filename, cfg.Width*cfg.Height
+	if !sufficient(cfg) {
+		ext := filepath.Ext(filename)
+		base := strings.TrimSuffix(filename, ext)
+		for _, suffix := range img.HiDPI.Suffixes {
+			candidate := base + suffix + ext
+			if img.checkAccess(repl, root, candidate) != nil {
+				continue
+			}
+			cfg, err := img.decodeConfig(candidate)
+			if err != nil {
+				continue
+			}
+			// the largest variant is used, if none is large enough
+			if cfg.Width*cfg.Height > selectedPixels {
+				selected, selectedPixels = candidate, cfg.Width*cfg.Height
+			}
+			if sufficient(cfg) {
+				selected = candidate
+				break
+			}
+		}
+	}
+
+	if selected != filename {
+		img.logger.Debug("selected high density variant",
+			zap.String("file", filename),
+			zap.String("variant", selected))
+	}
+	file, info, err = img.open(ctx, selected)
+	return selected, file, info, err
+}
+
+// decodeConfig returns the color model and dimensions of the image file.
+func (img *ImageFilter) decodeConfig(filename string) (image.Config, error) {
+	file, err := img.fileSystem.Open(filename)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer file.Close()
+	cfg, _, err := image.DecodeConfig(file)
+	return cfg, err
+}
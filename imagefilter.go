@@ -1,18 +1,24 @@
 package imagefilter
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"io/fs"
 	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
@@ -20,6 +26,8 @@ import (
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/disintegration/imaging"
+	"github.com/dustin/go-humanize"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 	_ "golang.org/x/image/webp"
 	"golang.org/x/sync/semaphore"
@@ -30,6 +38,12 @@ var (
 	ErrTooManyArgs = errors.New("too many arguments")
 )
 
+// Possible values of ImageFilter.OnTimeout.
+const (
+	onTimeoutError    = "error"
+	onTimeoutOriginal = "original"
+)
+
 // ImageFilter is a caddy module that can apply image filters to images from the filesystem at
 // runtime. It should be used together with a cache module, so filters don't have to be applied
 // repeatedly because it's an expensive operation.
@@ -38,12 +52,18 @@ type ImageFilter struct {
 	FileSystemRaw json.RawMessage `json:"file_system,omitempty" caddy:"namespace=caddy.fs inline_key=backend"`
 	fileSystem    fs.StatFS
 
+	// Pipeline is the ordered list of image filters to apply. Each entry is an image filter module
+	// object with its name in the "filter" field, e.g. {"filter": "resize", "width": "400"}.
+	PipelineRaw []json.RawMessage `json:"pipeline,omitempty" caddy:"namespace=http.handlers.image_filter.filter inline_key=filter"`
+
 	// Filters is a map of initialized image filters. Keys have the form
 	// "<position>_<image filter name>", where <position> specifies the order in which the image
 	// filters will be applied.
+	//
+	// Deprecated: Use Pipeline instead. It can't be used together with Pipeline.
 	FiltersRaw caddy.ModuleMap `json:"filters,omitempty"`
 
-	filters []Filter
+	filters []ContextFilter
 
 	logger *zap.Logger
 
@@ -55,6 +75,8 @@ type ImageFilter struct {
 
 	// FilterOrder is a slice of strings in the form "<position>_<image filter name>". Each entry
 	// should have a corresponding entry in the Filters map.
+	//
+	// Deprecated: Use Pipeline instead.
 	FilterOrder []string `json:"filter_order,omitempty"`
 
 	encodingOpts []imaging.EncodeOption
@@ -73,6 +95,112 @@ type ImageFilter struct {
 	// MaxConcurrent determines how many request can be served concurrently. Default is 0, which
 	// means unlimited
 	MaxConcurrent int64 `json:"max_concurrent,omitempty"`
+
+	// Timeout bounds the time that is spent on decoding, filtering and encoding an image. Waiting
+	// for a free slot (see MaxConcurrent) is not included. Default is 0, which means no timeout.
+	//
+	// The response is sent as soon as the timeout is exceeded, but the processing only stops at the
+	// next point where the context is checked: while decoding, between filters and inside of
+	// filters implementing ContextFilter (e.g. between the analysis and the cropping of smartcrop).
+	// A single image operation, that is already running, is finished in the background and keeps
+	// its slot and the CPU until then.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// OnTimeout determines the response if the timeout is exceeded. Possible values are:
+	//   * error: respond with status 503 Service Unavailable (default)
+	//   * original: respond with the original unfiltered image
+	OnTimeout string `json:"on_timeout,omitempty"`
+
+	// ServerTiming adds a Server-Timing header with the durations of decoding, each filter and
+	// encoding to the response. The image is encoded into a buffer before the response is written,
+	// like with Timeout.
+	ServerTiming bool `json:"server_timing,omitempty"`
+
+	// SurrogateKeys adds Surrogate-Key and Cache-Tag headers naming the source file (its path
+	// relative to the root) to the response, so caches can purge all variants of an image at once.
+	SurrogateKeys bool `json:"surrogate_keys,omitempty"`
+
+	// CacheControl sets the Cache-Control header of responses. By default, no header is set.
+	CacheControl *CacheControl `json:"cache_control,omitempty"`
+
+	// Source determines where the images come from. Possible values are:
+	//   * file: the file system (default)
+	//   * response: the response of the next handler, e.g. reverse_proxy or templates. Only
+	//     responses with status 200 and an image content type are filtered, others are passed
+	//     through untouched.
+	//   * origin: an HTTP server (see Origin). Default if Origin is configured.
+	//   * upload: the body of POST requests (see Upload). Default if Upload is configured.
+	Source string `json:"source,omitempty"`
+
+	// Origin configures fetching source images over HTTP.
+	Origin *Origin `json:"origin,omitempty"`
+
+	// Upload configures filtering of uploaded images.
+	Upload *Upload `json:"upload,omitempty"`
+
+	// TrySources is a list of path templates of source files relative to the root, that are tried
+	// in order. The first existing file is used. Besides caddy's placeholders, "{path.*}" is a
+	// shorthand for "{http.request.uri.path.*}", e.g. "{path.dir}/{path.file.base}.jpg". Default
+	// is the path of the request.
+	TrySources []string `json:"try_sources,omitempty"`
+	trySources []string
+
+	// Hide is a list of files or folders, that are never used as source files. The response is
+	// "404 Not Found" as if they didn't exist. It works like the hide subdirective of the
+	// file_server: Entries without a path separator match any file or folder of that name, e.g.
+	// "originals", and entries with a separator match the path and everything inside of it. Glob
+	// patterns and placeholders can be used.
+	Hide []string `json:"hide,omitempty"`
+
+	// Deny is a list of files or folders like Hide, but the response is "403 Forbidden".
+	Deny []string `json:"deny,omitempty"`
+
+	// RestrictSymlinks refuses source files, that are symbolic links (or inside of linked folders)
+	// to files outside of the root. The response is "403 Forbidden".
+	RestrictSymlinks bool `json:"restrict_symlinks,omitempty"`
+
+	// Sidecar is the suffix of the metadata file next to the source file, e.g. ".json" reads
+	// "photo.jpg.json" for "photo.jpg". The metadata contains a focal point, a manual crop region
+	// and an alternative text (see Sidecar type). It's exposed as placeholders and used as defaults
+	// by filters cropping the image. Empty disables reading metadata.
+	Sidecar string `json:"sidecar,omitempty"`
+
+	// HiDPI selects the source file from pre-rendered high density variants, if the source file is
+	// smaller than the target size.
+	HiDPI *HiDPI `json:"hidpi,omitempty"`
+
+	// Variants are named pipelines, that are applied to the result of the pipeline. If variants
+	// are configured, the response is a JSON manifest describing the encoded output of each
+	// variant, instead of an image. The image is decoded only once for all variants.
+	Variants []Variant `json:"variants,omitempty"`
+
+	// VariantsDir is the directory on the local disk, the outputs of the variants are written to as
+	// "<cache key>/<name>.<format>" (see the placeholder {http.image_filter.cache_key}). It can't
+	// contain placeholders, so clients can't choose where files are written. Existing outputs are
+	// not written again. The source of the outputs is recorded in "<cache key>/.source" for purging
+	// by prefix. By default, the outputs are contained in the manifest base64 encoded.
+	VariantsDir string `json:"variants_dir,omitempty"`
+
+	// Output determines the response. Possible values are:
+	//   * image: the filtered image (default)
+	//   * info: information about the source image as JSON (see InfoFields). It can only be used
+	//     with source file and without image filters.
+	Output string `json:"output,omitempty"`
+
+	// InfoFields are the fields of the info output. Possible values are width, height, format,
+	// size, orientation, alpha and dominant_color. The image is only decoded completely for alpha
+	// and dominant_color. Default is all fields.
+	InfoFields []string `json:"info_fields,omitempty"`
+
+	// MaxResponseSize is the maximum size in bytes of responses, that are filtered with source
+	// response. Larger responses are passed through untouched. Default is 32 MiB.
+	MaxResponseSize int64 `json:"max_response_size,omitempty"`
+
+	// id, pipeline, inFlight and queued are reported by the admin API.
+	id       uint64
+	pipeline []json.RawMessage
+	inFlight int64
+	queued   int64
 }
 
 // osFS is a simple fs.StatFS implementation that uses the local file system.
@@ -98,9 +226,6 @@ func (ImageFilter) CaddyModule() caddy.ModuleInfo {
 // parseCaddyfile parses the caddyfile configuration and initialises the handler.
 func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	img := new(ImageFilter)
-	filters := make(caddy.ModuleMap)
-	var filterOrder []string
-	filterIndex := 0
 	for h.Next() {
 		if len(h.RemainingArgs()) > 0 {
 			return nil, h.ArgErr()
@@ -168,52 +293,153 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 				}
 				img.MaxConcurrent = mc
 
-			default:
+			case "timeout":
+				args := h.RemainingArgs()
+				if len(args) != 1 {
+					return nil, h.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(args[0])
+				if err != nil {
+					return nil, h.Errf("invalid timeout: %w", err)
+				}
+				img.Timeout = caddy.Duration(dur)
+
+			case "on_timeout":
+				if !h.Args(&img.OnTimeout) {
+					return nil, h.ArgErr()
+				}
+
+			case "server_timing":
+				if h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				img.ServerTiming = true
+
+			case "surrogate_keys":
+				if h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				img.SurrogateKeys = true
+
+			case "cache_control":
+				cc, err := unmarshalCacheControl(h.Dispenser)
+				if err != nil {
+					return nil, err
+				}
+				img.CacheControl = cc
+
+			case "source":
+				if !h.Args(&img.Source) {
+					return nil, h.ArgErr()
+				}
+
+			case "origin":
+				if img.Origin != nil {
+					return nil, h.Err("origin already specified")
+				}
+				o, err := unmarshalOrigin(h.Dispenser)
+				if err != nil {
+					return nil, err
+				}
+				img.Origin = o
+
+			case "try_sources":
+				sources := h.RemainingArgs()
+				if len(sources) == 0 {
+					return nil, h.ArgErr()
+				}
+				img.TrySources = append(img.TrySources, sources...)
+
+			case "hide", "deny":
 				name := h.Val()
-				modID := "http.handlers.image_filter.filter." + name
-				mod, err := caddy.GetModule(modID)
+				patterns := h.RemainingArgs()
+				if len(patterns) == 0 {
+					return nil, h.ArgErr()
+				}
+				if name == "hide" {
+					img.Hide = append(img.Hide, patterns...)
+				} else {
+					img.Deny = append(img.Deny, patterns...)
+				}
+
+			case "restrict_symlinks":
+				if h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				img.RestrictSymlinks = true
+
+			case "sidecar":
+				img.Sidecar = defaultSidecarSuffix
+				if h.NextArg() {
+					img.Sidecar = h.Val()
+				}
+				if h.NextArg() {
+					return nil, h.ArgErr()
+				}
+
+			case "hidpi":
+				if img.HiDPI != nil {
+					return nil, h.Err("hidpi already specified")
+				}
+				hd, err := unmarshalHiDPI(h.Dispenser)
 				if err != nil {
-					return nil, h.Errf("unrecognized subdirective or filter '%s': %v", name, err)
+					return nil, err
 				}
+				img.HiDPI = hd
 
-				inst := mod.New()
-				unm, ok := inst.(caddyfile.Unmarshaler)
-				if !ok {
-					return nil, h.Errf("module '%s' is not a Caddyfile unmarshaler; is %T", mod.ID, inst)
+			case "variants":
+				if len(img.Variants) > 0 {
+					return nil, h.Err("variants already specified")
+				}
+				variants, dir, err := unmarshalVariants(h.Dispenser)
+				if err != nil {
+					return nil, err
 				}
+				img.Variants = variants
+				img.VariantsDir = dir
 
-				// copy segment
-				d := h.NewFromNextSegment()
-				// skip directive itself
-				d.Next()
+			case "info":
+				img.Output = outputInfo
+				img.InfoFields = append(img.InfoFields, h.RemainingArgs()...)
 
-				err = unm.UnmarshalCaddyfile(d)
+			case "accept_upload":
+				if img.Upload != nil {
+					return nil, h.Err("accept_upload already specified")
+				}
+				u, err := unmarshalUpload(h.Dispenser)
 				if err != nil {
-					return nil, h.Errf("configuring filter '%s': %v", name, err)
+					return nil, err
 				}
+				img.Upload = u
 
-				filter, ok := inst.(Filter)
-				if !ok {
-					return nil, h.Errf("module '%s' does not implement image filter", mod.ID)
+			case "max_response_size":
+				var sizeStr string
+				if !h.AllArgs(&sizeStr) {
+					return nil, h.ArgErr()
 				}
-				filterName := fmt.Sprintf("%04d_%s", filterIndex, name)
-				filters[filterName] = caddyconfig.JSON(filter, nil)
-				filterOrder = append(filterOrder, filterName)
-				filterIndex++
+				size, err := humanize.ParseBytes(sizeStr)
+				if err != nil {
+					return nil, h.Errf("invalid max_response_size: %v", err)
+				}
+				img.MaxResponseSize = int64(size)
+
+			default:
+				filter, err := UnmarshalFilter(h.Dispenser)
+				if err != nil {
+					return nil, err
+				}
+				img.PipelineRaw = append(img.PipelineRaw, filter)
 			}
 		}
 	}
 
-	img.FiltersRaw = filters
-	img.FilterOrder = make([]string, len(filterOrder))
-	copy(img.FilterOrder, filterOrder)
-
 	return img, nil
 }
 
 // Provision sets up image filter module.
 func (img *ImageFilter) Provision(ctx caddy.Context) error {
 	img.logger = ctx.Logger()
+	imageFilterMetrics.init.Do(initImageFilterMetrics)
 
 	// establish which file system (possibly a virtual one) we'll be using
 	if len(img.FileSystemRaw) > 0 {
@@ -227,27 +453,61 @@ func (img *ImageFilter) Provision(ctx caddy.Context) error {
 		img.fileSystem = osFS{}
 	}
 
+	if len(img.PipelineRaw) > 0 && len(img.FilterOrder) > 0 {
+		return errors.New("pipeline and filters/filter_order cannot be used together")
+	}
+
+	if len(img.PipelineRaw) > 0 {
+		// keep a copy of the configuration, loading the modules discards it
+		img.pipeline = append([]json.RawMessage(nil), img.PipelineRaw...)
+		filters, err := LoadPipeline(ctx, img, "PipelineRaw")
+		if err != nil {
+			return err
+		}
+		img.filters = filters
+	}
+
+	// legacy configuration
 	for _, filterName := range img.FilterOrder {
 		modConf, ok := img.FiltersRaw[filterName]
 		if !ok {
 			return fmt.Errorf("no image filter '%s' configured", filterName)
 		}
-		modID := "http.handlers.image_filter.filter." + filterName[5:]
+		_, name, found := strings.Cut(filterName, "_")
+		if !found {
+			return fmt.Errorf("invalid image filter key '%s'", filterName)
+		}
+		modID := "http.handlers.image_filter.filter." + name
 		mod, err := ctx.LoadModuleByID(modID, modConf)
 		if err != nil {
 			return fmt.Errorf("loading module '%s': %v", modID, err)
 		}
-		filter, ok := mod.(Filter)
-		if !ok {
-			return fmt.Errorf("module '%s' does not implement Filter", modID)
+		filter, err := asContextFilter(mod)
+		if err != nil {
+			return fmt.Errorf("module '%s': %v", modID, err)
 		}
 		img.filters = append(img.filters, filter)
+		img.pipeline = append(img.pipeline, caddyconfig.JSONModuleObject(mod, "filter", name, nil))
+	}
+
+	err := img.provisionVariants(ctx)
+	if err != nil {
+		return err
 	}
 
 	if img.Root == "" {
 		img.Root = "{http.vars.root}"
 	}
 
+	if img.HiDPI != nil {
+		img.HiDPI.provision()
+	}
+	img.provisionAccess()
+
+	for _, source := range img.TrySources {
+		img.trySources = append(img.trySources, strings.ReplaceAll(source, "{path.", "{http.request.uri.path."))
+	}
+
 	if img.JpegQuality == 0 {
 		img.JpegQuality = jpeg.DefaultQuality
 	}
@@ -259,14 +519,70 @@ func (img *ImageFilter) Provision(ctx caddy.Context) error {
 		img.concurrencySemaphore = semaphore.NewWeighted(img.MaxConcurrent)
 	}
 
+	if img.OnTimeout == "" {
+		img.OnTimeout = onTimeoutError
+	}
+
+	if img.CacheControl != nil {
+		img.CacheControl.provision()
+	}
+
+	if img.Output == "" {
+		img.Output = outputImage
+	}
+
+	if img.Source == "" {
+		img.Source = sourceFile
+		if img.Origin != nil {
+			img.Source = sourceOrigin
+		}
+		if img.Upload != nil {
+			img.Source = sourceUpload
+		}
+	}
+
+	if img.Origin != nil {
+		img.Origin.provision()
+	}
+	if img.Upload != nil {
+		img.Upload.provision()
+	}
+
+	if img.MaxResponseSize == 0 {
+		img.MaxResponseSize = defaultMaxResponseSize
+	}
+
+	registerHandler(img)
+
+	return nil
+}
+
+// Cleanup removes the handler from the handlers reported by the admin API.
+func (img *ImageFilter) Cleanup() error {
+	unregisterHandler(img)
 	return nil
 }
 
 // Validate validates the configuration of the image filter module.
 func (img *ImageFilter) Validate() error {
 	// this is just a very inefficient file_server otherwise
-	if len(img.FilterOrder) == 0 {
-		return errors.New("no image filters to apply configured")
+	switch img.Output {
+	case outputImage:
+		if len(img.filters) == 0 && len(img.Variants) == 0 {
+			return errors.New("no image filters to apply configured")
+		}
+	case outputInfo:
+		err := img.validateInfo()
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("output must be '%s' or '%s'", outputImage, outputInfo)
+	}
+
+	err := img.validateVariants()
+	if err != nil {
+		return err
 	}
 
 	for i, filterName := range img.FilterOrder {
@@ -290,19 +606,111 @@ func (img *ImageFilter) Validate() error {
 		return errors.New("max_concurrent must be greater or equal 0")
 	}
 
+	if img.Timeout < 0 {
+		return errors.New("timeout must be greater or equal 0")
+	}
+
+	if img.OnTimeout != onTimeoutError && img.OnTimeout != onTimeoutOriginal {
+		return fmt.Errorf("on_timeout must be '%s' or '%s'", onTimeoutError, onTimeoutOriginal)
+	}
+
+	if img.Origin != nil && img.Source != sourceOrigin {
+		return fmt.Errorf("origin cannot be used with source '%s'", img.Source)
+	}
+	if img.Upload != nil && img.Source != sourceUpload {
+		return fmt.Errorf("accept_upload cannot be used with source '%s'", img.Source)
+	}
+	if img.Sidecar != "" && img.Source != sourceFile {
+		return fmt.Errorf("sidecar cannot be used with source '%s'", img.Source)
+	}
+	if (len(img.Hide) > 0 || len(img.Deny) > 0 || img.RestrictSymlinks) && img.Source != sourceFile {
+		return fmt.Errorf("hide, deny and restrict_symlinks cannot be used with source '%s'", img.Source)
+	}
+	if len(img.TrySources) > 0 && img.Source != sourceFile {
+		return fmt.Errorf("try_sources cannot be used with source '%s'", img.Source)
+	}
+	if img.HiDPI != nil {
+		if img.Source != sourceFile {
+			return fmt.Errorf("hidpi cannot be used with source '%s'", img.Source)
+		}
+		err := img.HiDPI.validate()
+		if err != nil {
+			return err
+		}
+	}
+	switch img.Source {
+	case sourceFile, sourceResponse:
+	case sourceOrigin:
+		if img.Origin == nil {
+			return errors.New("source 'origin' requires an origin")
+		}
+		err := img.Origin.validate()
+		if err != nil {
+			return err
+		}
+	case sourceUpload:
+		if img.Upload == nil {
+			return errors.New("source 'upload' requires accept_upload")
+		}
+		err := img.Upload.validate()
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("source must be '%s', '%s', '%s' or '%s'", sourceFile, sourceResponse, sourceOrigin, sourceUpload)
+	}
+
+	if img.MaxResponseSize < 0 {
+		return errors.New("max_response_size must be greater or equal 0")
+	}
+
+	if img.CacheControl != nil {
+		err := img.CacheControl.validate()
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 // ServeHTTP looks for the file in the current root directory and applys the configured filters.
+//
+// The following placeholders are set before the response is written, so they can be used in
+// response headers and access logs:
+//
+//	{http.image_filter.source_width}    width of the source image
+//	{http.image_filter.source_height}   height of the source image
+//	{http.image_filter.source_format}   format of the source image
+//	{http.image_filter.output_width}    width of the filtered image
+//	{http.image_filter.output_height}   height of the filtered image
+//	{http.image_filter.output_format}   format of the response image
+//	{http.image_filter.filter_duration} time spent on decoding and filtering
+//	{http.image_filter.duration}        time spent on decoding, filtering and encoding, only set
+//	                                    after the response is written, if neither Timeout nor
+//	                                    ServerTiming is set
+//	{http.image_filter.cache}           result of the cache of source images fetched from the
+//	                                    origin: "hit", "revalidated" or "miss", "none" for
+//	                                    other sources
+//	{http.image_filter.filter_errors}   number of filters that failed and were skipped
+//	{http.image_filter.cache_key}       key of the response built from the source file, the
+//	                                    resolved pipeline and the encoding options
 func (img *ImageFilter) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
 	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("http.image_filter.cache", cacheNone)
 
-	if img.concurrencySemaphore != nil {
-		err := img.concurrencySemaphore.Acquire(r.Context(), 1)
-		if err != nil {
-			return caddyhttp.Error(http.StatusInternalServerError, err)
-		}
-		defer img.concurrencySemaphore.Release(1)
+	switch img.Source {
+	case sourceResponse:
+		return img.serveResponse(w, r, repl, next)
+	case sourceOrigin:
+		return img.serveOrigin(w, r, repl)
+	case sourceUpload:
+		return img.serveUpload(w, r, repl)
+	}
+
+	release, err := img.reserve(r.Context())
+	if err != nil {
+		return err
 	}
 
 	root := repl.ReplaceAll(img.Root, ".")
@@ -310,68 +718,463 @@ func (img *ImageFilter) ServeHTTP(w http.ResponseWriter, r *http.Request, next c
 		root = "."
 	}
 
-	uri := repl.ReplaceAll(r.URL.Path, "")
-	filename := filepath.Join(root, filepath.Clean("/"+uri))
+	sources := img.trySources
+	if len(sources) == 0 {
+		sources = []string{r.URL.Path}
+	}
+
+	// the first existing file of the sources is used
+	var path, filename string
+	var file fs.File
+	var info fs.FileInfo
+	for _, source := range sources {
+		uri := repl.ReplaceAll(source, "")
+		path = filepath.ToSlash(filepath.Clean("/" + uri))
+		filename = filepath.Join(root, path)
+
+		err = img.checkAccess(repl, root, filename)
+		if err != nil {
+			var handlerErr caddyhttp.HandlerError
+			if errors.As(err, &handlerErr) && handlerErr.StatusCode == http.StatusForbidden {
+				release()
+				imageFilterMetrics.errors.WithLabelValues(errorKindDenied).Inc()
+				return err
+			}
+			continue
+		}
 
-	_, err := img.fileSystem.Stat(filename)
+		file, info, err = img.open(r.Context(), filename)
+		if err == nil && info.IsDir() {
+			file.Close()
+			err = fmt.Errorf("%s is a directory", filename)
+		}
+		if err == nil {
+			break
+		}
+	}
 	if err != nil {
+		release()
+		imageFilterMetrics.errors.WithLabelValues(errorKindNotFound).Inc()
 		return caddyhttp.Error(http.StatusNotFound, err)
 	}
-	file, err := img.fileSystem.Open(filename)
+
+	// the sidecar belongs to the requested file, not to its high density variants
+	var sidecar *Sidecar
+	var sidecarID string
+	if img.Sidecar != "" {
+		sidecar, sidecarID = img.readSidecar(repl, filename)
+	}
+
+	if img.HiDPI != nil {
+		requested := filename
+		filename, file, info, err = img.selectDensity(r.Context(), repl, root, filename, file, info)
+		if err != nil {
+			release()
+			imageFilterMetrics.errors.WithLabelValues(errorKindNotFound).Inc()
+			return caddyhttp.Error(http.StatusNotFound, err)
+		}
+		if sidecar != nil && filename != requested {
+			// the crop region is in pixels of the requested file
+			cfg, err := img.decodeConfig(requested)
+			if err == nil {
+				sidecar.width, sidecar.height = cfg.Width, cfg.Height
+			}
+		}
+	}
+	imageFilterMetrics.inputBytes.Observe(float64(info.Size()))
+
+	img.setCacheKey(repl, path,
+		filepath.Base(filename),
+		strconv.FormatInt(info.Size(), 10),
+		strconv.FormatInt(info.ModTime().UnixNano(), 10),
+		sidecarID)
+	if img.SurrogateKeys {
+		setSurrogateKeys(w, path)
+	}
+
+	if img.Output == outputInfo {
+		defer release()
+		defer file.Close()
+		return img.serveInfo(w, repl, file, info)
+	}
+
+	return img.process(w, r, repl, file, filename, release, func() error {
+		return img.serveOriginal(w, r, filename)
+	})
+}
+
+// reserve waits for a free slot (see MaxConcurrent) and counts the request as in flight. The
+// returned function frees the slot again.
+func (img *ImageFilter) reserve(ctx context.Context) (func(), error) {
+	if img.concurrencySemaphore != nil {
+		err := img.acquire(ctx)
+		if err != nil {
+			return nil, caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+	}
+	imageFilterMetrics.inFlight.Inc()
+	atomic.AddInt64(&img.inFlight, 1)
+	return func() {
+		imageFilterMetrics.inFlight.Dec()
+		atomic.AddInt64(&img.inFlight, -1)
+		if img.concurrencySemaphore != nil {
+			img.concurrencySemaphore.Release(1)
+		}
+	}, nil
+}
+
+// process decodes the image from src, applies the filters and writes the encoded image to w. name
+// identifies the source in logs. It takes over the slot and frees it with release after the work
+// is done. original responds with the unfiltered image, if the timeout is exceeded (see
+// OnTimeout).
+func (img *ImageFilter) process(w http.ResponseWriter, r *http.Request, repl *caddy.Replacer, src io.ReadCloser, name string, release func(), original func() error) error {
+	defer func() { release() }()
+
+	start := time.Now()
+	if img.Timeout <= 0 && !img.ServerTiming {
+		defer src.Close()
+
+		reqImg, formatName, err := img.filterImage(r.Context(), r, repl, src)
+		if errors.Is(err, context.Canceled) {
+			imageFilterMetrics.errors.WithLabelValues(errorKindCanceled).Inc()
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(img.Variants) > 0 {
+			manifest, err := img.variants(r.Context(), r, repl, reqImg, formatName)
+			if err != nil {
+				return err
+			}
+			repl.Set("http.image_filter.duration", time.Since(start))
+			img.setCacheControl(w, repl, false)
+			setContentType(w, "json")
+			_, err = w.Write(manifest)
+			if err != nil {
+				img.logger.Error("failed to write manifest", zap.Error(err))
+			}
+			return nil
+		}
+
+		img.setCacheControl(w, repl, false)
+		setContentType(w, formatName)
+		// the response is written while encoding, so the duration is only available afterwards
+		// (e.g. in access logs)
+		err = img.encode(r.Context(), w, reqImg, formatName)
+		repl.Set("http.image_filter.duration", time.Since(start))
+		if err != nil {
+			img.logger.Error("failed to encode image", zap.Error(err))
+		}
+		return nil
+	}
+
+	// buffered mode: the image is encoded completely before the response is written
+	ctx, cancel := r.Context(), context.CancelFunc(func() {})
+	if img.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(img.Timeout))
+	}
+	defer cancel()
+
+	var timing *serverTiming
+	if img.ServerTiming {
+		timing = new(serverTiming)
+		ctx = context.WithValue(ctx, serverTimingCtxKey{}, timing)
+	}
+
+	type result struct {
+		buf        *bytes.Buffer
+		formatName string
+		err        error
+	}
+	done := make(chan result, 1)
+
+	// The worker takes over the concurrency slot, so it's only freed after the work is actually
+	// stopped and not already when the timeout is exceeded. It gets its own replacer and a copy of
+	// the request, because both are used by caddy again after the handler returned. The replacer
+	// in the context of the copy is replaced as well, since filters and matchers may take it from
+	// there.
+	workerRelease := release
+	release = func() {}
+	wr := newWorkerReplacer(repl)
+	workerCtx := context.WithValue(ctx, caddy.ReplacerCtxKey, wr.repl)
+	workerReq := r.Clone(workerCtx)
+	go func() {
+		defer workerRelease()
+		defer src.Close()
+
+		ctx, r, repl := workerCtx, workerReq, wr.repl
+		reqImg, formatName, err := img.filterImage(ctx, r, repl, src)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+
+		if len(img.Variants) > 0 {
+			manifest, err := img.variants(ctx, r, repl, reqImg, formatName)
+			repl.Set("http.image_filter.duration", time.Since(start))
+			done <- result{buf: bytes.NewBuffer(manifest), formatName: "json", err: err}
+			return
+		}
+
+		buf := new(bytes.Buffer)
+		err = img.encode(ctx, buf, reqImg, formatName)
+		repl.Set("http.image_filter.duration", time.Since(start))
+		done <- result{buf: buf, formatName: formatName, err: err}
+	}()
+
+	var res result
+	select {
+	case res = <-done:
+		wr.merge()
+	case <-ctx.Done():
+		wr.detach()
+		res.err = ctx.Err()
+	}
+
+	if errors.Is(res.err, context.Canceled) {
+		imageFilterMetrics.errors.WithLabelValues(errorKindCanceled).Inc()
+	}
+	if errors.Is(res.err, context.DeadlineExceeded) && r.Context().Err() == nil {
+		imageFilterMetrics.errors.WithLabelValues(errorKindTimeout).Inc()
+		img.logger.Warn("image filtering timed out",
+			zap.String("file", name),
+			zap.Duration("timeout", time.Duration(img.Timeout)))
+		if img.OnTimeout == onTimeoutOriginal {
+			img.setCacheControl(w, repl, true)
+			return original()
+		}
+		return caddyhttp.Error(http.StatusServiceUnavailable, res.err)
+	}
+	if res.err != nil {
+		return res.err
+	}
+
+	if timing != nil {
+		w.Header().Add("Server-Timing", timing.String())
+	}
+	img.setCacheControl(w, repl, false)
+	setContentType(w, res.formatName)
+	_, err := res.buf.WriteTo(w)
 	if err != nil {
-		return caddyhttp.Error(http.StatusNotFound, err)
+		img.logger.Error("failed to write image", zap.Error(err))
 	}
-	defer file.Close()
 
-	reqImg, formatName, err := image.Decode(file)
+	return nil
+}
+
+// filterImage decodes the image from the reader and applies all configured filters. It returns the
+// filtered image and the name of the format in which the image should be encoded.
+func (img *ImageFilter) filterImage(ctx context.Context, r *http.Request, repl *caddy.Replacer, reader io.Reader) (image.Image, string, error) {
+	start := time.Now()
+	_, span := startSpan(ctx, "image.Decode")
+	reqImg, formatName, err := image.Decode(ctxReader{ctx: ctx, r: reader})
+	if ctx.Err() != nil {
+		endSpan(span, ctx.Err())
+		return nil, "", ctx.Err()
+	}
 	if err != nil {
+		endSpan(span, err)
+		imageFilterMetrics.errors.WithLabelValues(errorKindDecode).Inc()
 		img.logger.Warn("decoding of image failed", zap.Error(err))
-		return caddyhttp.Error(http.StatusUnsupportedMediaType, err)
+		return nil, "", caddyhttp.Error(http.StatusUnsupportedMediaType, err)
 	}
-	file.Close()
+	span.SetAttributes(
+		attribute.String("image_filter.format", formatName),
+		attribute.Int("image_filter.width", reqImg.Bounds().Dx()),
+		attribute.Int("image_filter.height", reqImg.Bounds().Dy()))
+	endSpan(span, nil)
+	imageFilterMetrics.decodeDuration.WithLabelValues(formatName).Observe(time.Since(start).Seconds())
+	recordTiming(ctx, "decode", time.Since(start))
+	imageFilterMetrics.inputPixels.Observe(float64(reqImg.Bounds().Dx() * reqImg.Bounds().Dy()))
 
-	for _, filter := range img.filters {
-		if r.Context().Err() != nil {
-			return r.Context().Err()
+	repl.Set("image_filter.format", formatName)
+	repl.Set("image_filter.source_width", reqImg.Bounds().Dx())
+	repl.Set("image_filter.source_height", reqImg.Bounds().Dy())
+	setDimensionPlaceholders(repl, reqImg)
+	repl.Set("http.image_filter.source_width", reqImg.Bounds().Dx())
+	repl.Set("http.image_filter.source_height", reqImg.Bounds().Dy())
+	repl.Set("http.image_filter.source_format", formatName)
+
+	reqImg, err = ApplyFilters(ctx, r, repl, img.filters, reqImg, img.logger)
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, err = imaging.FormatFromExtension(formatName)
+	if err != nil {
+		img.logger.Info("not supported format, falling back to png", zap.String("format", formatName))
+		formatName = "png"
+	}
+
+	repl.Set("http.image_filter.output_width", reqImg.Bounds().Dx())
+	repl.Set("http.image_filter.output_height", reqImg.Bounds().Dy())
+	repl.Set("http.image_filter.output_format", formatName)
+	repl.Set("http.image_filter.filter_duration", time.Since(start))
+	if _, ok := repl.Get("http.image_filter.filter_errors"); !ok {
+		repl.Set("http.image_filter.filter_errors", 0)
+	}
+
+	return reqImg, formatName, nil
+}
+
+// ApplyFilters applies the filters in order to the image and returns the new image. If a filter
+// fails, the error is logged and the filter is skipped. {image_filter.width} and
+// {image_filter.height} are updated after each filter. An error is only returned if the context is
+// done.
+func ApplyFilters(ctx context.Context, r *http.Request, repl *caddy.Replacer, filters []ContextFilter, img image.Image, logger *zap.Logger) (image.Image, error) {
+	imageFilterMetrics.init.Do(initImageFilterMetrics)
+
+	for _, filter := range filters {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		name := filterName(filter)
+		start := time.Now()
+		filterCtx, span := startSpan(ctx, "Filter.Apply")
+		span.SetAttributes(filterAttributes(span, filter, repl)...)
+		newImg, err := filter.ApplyContext(filterCtx, r, repl, img)
+		endSpan(span, err)
+		if err != nil && errors.Is(err, ctx.Err()) {
+			// canceled, the filter itself didn't fail
+			return nil, ctx.Err()
 		}
-		newImg, err := filter.Apply(repl, reqImg)
+		result := filterResultOK
 		if err != nil {
-			img.logger.Warn("error applying image filter: ", zap.Error(err))
+			result = filterResultError
+		}
+		imageFilterMetrics.filterDuration.WithLabelValues(name, result).Observe(time.Since(start).Seconds())
+		recordTiming(ctx, name, time.Since(start))
+		if err != nil {
+			imageFilterMetrics.errors.WithLabelValues(errorKindFilter).Inc()
+			filterErrors, _ := repl.Get("http.image_filter.filter_errors")
+			n, _ := filterErrors.(int)
+			repl.Set("http.image_filter.filter_errors", n+1)
+			logger.Warn("error applying image filter: ", zap.String("filter", name), zap.Error(err))
 			continue
 		}
-		reqImg = newImg
+		img = newImg
+		setDimensionPlaceholders(repl, img)
 	}
 
-	format, err := imaging.FormatFromExtension(formatName)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return img, nil
+}
+
+// setDimensionPlaceholders sets {image_filter.width} and {image_filter.height} to the dimensions
+// of the current image, so they can be used in the arguments of the following filters.
+func setDimensionPlaceholders(repl *caddy.Replacer, reqImg image.Image) {
+	repl.Set("image_filter.width", reqImg.Bounds().Dx())
+	repl.Set("image_filter.height", reqImg.Bounds().Dy())
+}
+
+// open opens the file and returns it together with its file info.
+func (img *ImageFilter) open(ctx context.Context, filename string) (fs.File, fs.FileInfo, error) {
+	_, span := startSpan(ctx, "Stat/Open", attribute.String("image_filter.file", filename))
+	info, err := img.fileSystem.Stat(filename)
 	if err != nil {
-		img.logger.Info("not supported format, falling back to png", zap.String("format", formatName))
-		format = imaging.PNG
-		formatName = "png"
+		endSpan(span, err)
+		return nil, nil, err
 	}
+	file, err := img.fileSystem.Open(filename)
+	endSpan(span, err)
+	return file, info, err
+}
 
-	if w.Header().Get("Content-Type") == "" {
-		mtyp := mime.TypeByExtension("." + formatName)
-		if mtyp == "" {
-			// do not allow Go to sniff the content-type; see
-			// https://www.youtube.com/watch?v=8t8JYpt0egE
-			w.Header()["Content-Type"] = nil
-		} else {
-			w.Header().Set("Content-Type", mtyp)
-		}
+// encode writes the image in the given format with the configured encoding options.
+func (img *ImageFilter) encode(ctx context.Context, w io.Writer, reqImg image.Image, formatName string) error {
+	format, err := imaging.FormatFromExtension(formatName)
+	if err != nil {
+		return err
 	}
 
-	if r.Context().Err() != nil {
-		return r.Context().Err()
+	start := time.Now()
+	_, span := startSpan(ctx, "imaging.Encode", attribute.String("image_filter.format", formatName))
+	cw := &countingWriter{w: w}
+	err = imaging.Encode(cw, reqImg, format, img.encodingOpts...)
+	span.SetAttributes(attribute.Int64("image_filter.bytes", cw.n))
+	endSpan(span, err)
+	if err != nil {
+		imageFilterMetrics.errors.WithLabelValues(errorKindEncode).Inc()
+		return err
 	}
+	imageFilterMetrics.encodeDuration.WithLabelValues(formatName).Observe(time.Since(start).Seconds())
+	recordTiming(ctx, "encode", time.Since(start))
+	imageFilterMetrics.outputBytes.Observe(float64(cw.n))
+	imageFilterMetrics.outputPixels.Observe(float64(reqImg.Bounds().Dx() * reqImg.Bounds().Dy()))
+	return nil
+}
+
+// acquire waits for a free slot of the concurrency semaphore.
+func (img *ImageFilter) acquire(ctx context.Context) error {
+	imageFilterMetrics.queueDepth.Inc()
+	defer imageFilterMetrics.queueDepth.Dec()
+	atomic.AddInt64(&img.queued, 1)
+	defer atomic.AddInt64(&img.queued, -1)
 
-	err = imaging.Encode(w, reqImg, format, img.encodingOpts...)
+	start := time.Now()
+	err := img.concurrencySemaphore.Acquire(ctx, 1)
+	imageFilterMetrics.semaphoreWait.Observe(time.Since(start).Seconds())
+	return err
+}
+
+// serveOriginal responds with the unfiltered image file.
+func (img *ImageFilter) serveOriginal(w http.ResponseWriter, r *http.Request, filename string) error {
+	info, err := img.fileSystem.Stat(filename)
+	if err != nil {
+		return caddyhttp.Error(http.StatusNotFound, err)
+	}
+	file, err := img.fileSystem.Open(filename)
 	if err != nil {
-		img.logger.Error("failed to encode image", zap.Error(err))
+		return caddyhttp.Error(http.StatusNotFound, err)
+	}
+	defer file.Close()
+
+	if rs, ok := file.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, info.Name(), info.ModTime(), rs)
+		return nil
 	}
 
+	setContentType(w, strings.TrimPrefix(filepath.Ext(filename), "."))
+	_, err = io.Copy(w, file)
+	if err != nil {
+		img.logger.Error("failed to write image", zap.Error(err))
+	}
 	return nil
 }
 
+// setContentType sets the Content-Type header according to the format name, if it's not already
+// set.
+func setContentType(w http.ResponseWriter, formatName string) {
+	if w.Header().Get("Content-Type") != "" {
+		return
+	}
+	mtyp := mime.TypeByExtension("." + formatName)
+	if mtyp == "" {
+		// do not allow Go to sniff the content-type; see
+		// https://www.youtube.com/watch?v=8t8JYpt0egE
+		w.Header()["Content-Type"] = nil
+	} else {
+		w.Header().Set("Content-Type", mtyp)
+	}
+}
+
+// ctxReader is an io.Reader that stops reading as soon as the context is done, so decoding of large
+// images can be aborted early.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
 // Filter is a image filter that can be applied to an image.
 type Filter interface {
 	caddyfile.Unmarshaler
@@ -380,10 +1183,108 @@ type Filter interface {
 	Apply(*caddy.Replacer, image.Image) (image.Image, error)
 }
 
+// ContextFilter is an image filter that has access to the request and a context, that is canceled
+// if the request is done or the timeout is exceeded. If a filter implements both ContextFilter and
+// Filter, ApplyContext is used.
+type ContextFilter interface {
+	caddyfile.Unmarshaler
+
+	// ApplyContext applies the image filter to an image and returns the new image. Long running
+	// filters should stop early and return ctx.Err() if the context is done.
+	ApplyContext(context.Context, *http.Request, *caddy.Replacer, image.Image) (image.Image, error)
+}
+
+// HasPlaceholder reports whether a filter argument contains placeholders. Arguments without
+// placeholders should be parsed and validated once at provision time, so configuration errors are
+// detected early.
+func HasPlaceholder(arg string) bool {
+	return strings.ContainsAny(arg, "{}")
+}
+
+// UnmarshalFilter sets up the image filter at the current position of the dispenser (the token is
+// the filter name) and returns its configuration as used in pipelines, with the filter name in the
+// "filter" field. The dispenser is advanced to the end of the filter's segment.
+func UnmarshalFilter(d *caddyfile.Dispenser) (json.RawMessage, error) {
+	name := d.Val()
+	modID := "http.handlers.image_filter.filter." + name
+	mod, err := caddy.GetModule(modID)
+	if err != nil {
+		return nil, d.Errf("unrecognized subdirective or filter '%s': %v", name, err)
+	}
+
+	inst := mod.New()
+	unm, ok := inst.(caddyfile.Unmarshaler)
+	if !ok {
+		return nil, d.Errf("module '%s' is not a Caddyfile unmarshaler; is %T", mod.ID, inst)
+	}
+
+	// copy segment
+	segment := d.NewFromNextSegment()
+	// skip directive itself
+	segment.Next()
+
+	err = unm.UnmarshalCaddyfile(segment)
+	if err != nil {
+		return nil, d.Errf("configuring filter '%s': %v", name, err)
+	}
+
+	_, isFilter := inst.(Filter)
+	_, isContextFilter := inst.(ContextFilter)
+	if !isFilter && !isContextFilter {
+		return nil, d.Errf("module '%s' does not implement image filter", mod.ID)
+	}
+
+	return caddyconfig.JSONModuleObject(inst, "filter", name, nil), nil
+}
+
+// LoadPipeline loads the image filter modules of a pipeline field. The field has to be a
+// []json.RawMessage with the struct tag
+// `caddy:"namespace=http.handlers.image_filter.filter inline_key=filter"`.
+func LoadPipeline(ctx caddy.Context, structPointer any, fieldName string) ([]ContextFilter, error) {
+	mods, err := ctx.LoadModule(structPointer, fieldName)
+	if err != nil {
+		return nil, fmt.Errorf("loading image filter modules: %v", err)
+	}
+
+	var filters []ContextFilter
+	for i, mod := range mods.([]any) {
+		filter, err := asContextFilter(mod)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline position %d: %v", i, err)
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+// filterAdapter makes a Filter usable as ContextFilter.
+type filterAdapter struct {
+	Filter
+}
+
+// ApplyContext calls Apply of the wrapped filter.
+func (fa filterAdapter) ApplyContext(_ context.Context, _ *http.Request, repl *caddy.Replacer, img image.Image) (image.Image, error) {
+	return fa.Apply(repl, img)
+}
+
+// asContextFilter returns the module as ContextFilter, Filter implementations are wrapped
+// accordingly.
+func asContextFilter(mod any) (ContextFilter, error) {
+	switch filter := mod.(type) {
+	case ContextFilter:
+		return filter, nil
+	case Filter:
+		return filterAdapter{filter}, nil
+	default:
+		return nil, errors.New("does not implement Filter or ContextFilter")
+	}
+}
+
 // Interface guards.
 var (
 	_ caddy.Provisioner           = (*ImageFilter)(nil)
 	_ caddy.Validator             = (*ImageFilter)(nil)
+	_ caddy.CleanerUpper          = (*ImageFilter)(nil)
 	_ caddyhttp.MiddlewareHandler = (*ImageFilter)(nil)
 	_ caddy.Module                = (*ImageFilter)(nil)
 )
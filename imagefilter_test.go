@@ -0,0 +1,280 @@
+package imagefilter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// testFilter is an image filter for tests, that sleeps before it returns the image unchanged.
+type testFilter struct {
+	sleep time.Duration
+}
+
+func (testFilter) UnmarshalCaddyfile(*caddyfile.Dispenser) error { return nil }
+
+func (f testFilter) ApplyContext(_ context.Context, _ *http.Request, repl *caddy.Replacer, img image.Image) (image.Image, error) {
+	// ignores the context on purpose like a filter, that can't be interrupted
+	time.Sleep(f.sleep)
+	repl.Set("image_filter.test", true)
+	return img, nil
+}
+
+// testPNG returns an encoded PNG image.
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, width, height)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newTestImageFilter(filters ...ContextFilter) *ImageFilter {
+	imageFilterMetrics.init.Do(initImageFilterMetrics)
+	return &ImageFilter{
+		logger:    zap.NewNop(),
+		filters:   filters,
+		OnTimeout: onTimeoutError,
+	}
+}
+
+func TestProcessTimeoutDetachesReplacer(t *testing.T) {
+	img := newTestImageFilter(testFilter{sleep: 50 * time.Millisecond})
+	img.Timeout = caddy.Duration(5 * time.Millisecond)
+
+	repl := caddy.NewReplacer()
+	r := httptest.NewRequest(http.MethodGet, "/test.png", nil)
+	w := httptest.NewRecorder()
+	released := make(chan struct{})
+	src := io.NopCloser(bytes.NewReader(testPNG(t, 10, 10)))
+
+	err := img.process(w, r, repl, src, "test.png", func() { close(released) }, nil)
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %v", err)
+	}
+
+	// caddy keeps using the replacer and the request while the worker is still running
+	for i := 0; i < 1000; i++ {
+		repl.Set("http.error.status_code", i)
+		repl.Get("http.image_filter.filter_errors")
+		r.URL.Path = "/error"
+	}
+
+	<-released
+	if _, ok := repl.Get("image_filter.test"); ok {
+		t.Error("placeholder of the timed out worker was set in the request's replacer")
+	}
+}
+
+func TestProcessBufferedSetsPlaceholders(t *testing.T) {
+	img := newTestImageFilter(testFilter{})
+	img.Timeout = caddy.Duration(time.Minute)
+
+	repl := caddy.NewReplacer()
+	r := httptest.NewRequest(http.MethodGet, "/test.png", nil)
+	w := httptest.NewRecorder()
+	src := io.NopCloser(bytes.NewReader(testPNG(t, 20, 10)))
+
+	err := img.process(w, r, repl, src, "test.png", func() {}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]any{
+		"http.image_filter.source_width":  20,
+		"http.image_filter.output_height": 10,
+		"http.image_filter.output_format": "png",
+		"http.image_filter.filter_errors": 0,
+	} {
+		if got, _ := repl.Get(key); got != want {
+			t.Errorf("%s = %v, want %v", key, got, want)
+		}
+	}
+	if got := w.Header().Get("Content-Type"); got != "image/png" {
+		t.Errorf("Content-Type = %q, want image/png", got)
+	}
+}
+
+// failingFilter is an image filter for tests, that always fails.
+type failingFilter struct{}
+
+func (failingFilter) UnmarshalCaddyfile(*caddyfile.Dispenser) error { return nil }
+
+func (failingFilter) ApplyContext(context.Context, *http.Request, *caddy.Replacer, image.Image) (image.Image, error) {
+	return nil, errors.New("failed")
+}
+
+func TestApplyFiltersObservesFailedFilters(t *testing.T) {
+	imageFilterMetrics.init.Do(initImageFilterMetrics)
+	count := func(result string) uint64 {
+		t.Helper()
+		m := new(dto.Metric)
+		err := imageFilterMetrics.filterDuration.WithLabelValues("unknown", result).(prometheus.Histogram).Write(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.GetHistogram().GetSampleCount()
+	}
+	okBefore, errorBefore := count(filterResultOK), count(filterResultError)
+
+	repl := caddy.NewReplacer()
+	src := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	_, err := ApplyFilters(context.Background(), nil, repl, []ContextFilter{failingFilter{}, testFilter{}}, src, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := count(filterResultError) - errorBefore; got != 1 {
+		t.Errorf("observed %d failed filters, want 1", got)
+	}
+	if got := count(filterResultOK) - okBefore; got != 1 {
+		t.Errorf("observed %d successful filters, want 1", got)
+	}
+	if got, _ := repl.Get("http.image_filter.filter_errors"); got != 1 {
+		t.Errorf("filter_errors = %v, want 1", got)
+	}
+}
+
+// cancelingFilter cancels the pipeline while it's applied, like a timeout would.
+type cancelingFilter struct {
+	cancel context.CancelFunc
+}
+
+func (cancelingFilter) UnmarshalCaddyfile(*caddyfile.Dispenser) error { return nil }
+
+func (f cancelingFilter) ApplyContext(ctx context.Context, _ *http.Request, _ *caddy.Replacer, img image.Image) (image.Image, error) {
+	f.cancel()
+	return img, fmt.Errorf("stopped: %w", ctx.Err())
+}
+
+func TestApplyFiltersCanceled(t *testing.T) {
+	imageFilterMetrics.init.Do(initImageFilterMetrics)
+	filterErrors := func() float64 {
+		t.Helper()
+		m := new(dto.Metric)
+		err := imageFilterMetrics.errors.WithLabelValues(errorKindFilter).Write(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	before := filterErrors()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	core, logs := observer.New(zap.WarnLevel)
+	repl := caddy.NewReplacer()
+	src := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	filters := []ContextFilter{cancelingFilter{cancel: cancel}, testFilter{}}
+	_, err := ApplyFilters(ctx, nil, repl, filters, src, zap.New(core))
+	if err != context.Canceled {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+
+	if got := filterErrors() - before; got != 0 {
+		t.Errorf("counted %v filter errors, want 0", got)
+	}
+	if got, ok := repl.Get("http.image_filter.filter_errors"); ok {
+		t.Errorf("filter_errors = %v, want unset", got)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("logged %d warnings, want none", logs.Len())
+	}
+	if _, ok := repl.Get("image_filter.test"); ok {
+		t.Error("filter after the cancellation was applied")
+	}
+}
+
+func TestProcessDurationIncludesEncoding(t *testing.T) {
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		img := newTestImageFilter(testFilter{})
+		img.Timeout = caddy.Duration(timeout)
+
+		repl := caddy.NewReplacer()
+		r := httptest.NewRequest(http.MethodGet, "/test.png", nil)
+		w := httptest.NewRecorder()
+		src := io.NopCloser(bytes.NewReader(testPNG(t, 500, 500)))
+
+		err := img.process(w, r, repl, src, "test.png", func() {}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filterDuration, _ := repl.Get("http.image_filter.filter_duration")
+		duration, _ := repl.Get("http.image_filter.duration")
+		fd, ok1 := filterDuration.(time.Duration)
+		d, ok2 := duration.(time.Duration)
+		if !ok1 || !ok2 {
+			t.Fatalf("timeout %v: filter_duration = %v, duration = %v", timeout, filterDuration, duration)
+		}
+		if d <= fd {
+			t.Errorf("timeout %v: duration %v doesn't include encoding (filter_duration %v)", timeout, d, fd)
+		}
+	}
+}
+
+// requestReplacerFilter is an image filter for tests, that reads the width from the replacer in
+// the request's context like caddy's matchers do.
+type requestReplacerFilter struct {
+	sleep time.Duration
+	width chan any
+}
+
+func (requestReplacerFilter) UnmarshalCaddyfile(*caddyfile.Dispenser) error { return nil }
+
+func (f requestReplacerFilter) ApplyContext(_ context.Context, r *http.Request, _ *caddy.Replacer, img image.Image) (image.Image, error) {
+	time.Sleep(f.sleep)
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	var width any
+	for i := 0; i < 1000; i++ {
+		width, _ = repl.Get("image_filter.width")
+	}
+	f.width <- width
+	return img, nil
+}
+
+func TestProcessWorkerRequestReplacer(t *testing.T) {
+	for _, timeout := range []time.Duration{0, time.Minute, 5 * time.Millisecond} {
+		filter := requestReplacerFilter{width: make(chan any, 1)}
+		if timeout > 0 && timeout < time.Second {
+			filter.sleep = 20 * time.Millisecond
+		}
+		img := newTestImageFilter(filter)
+		img.Timeout = caddy.Duration(timeout)
+
+		repl := caddy.NewReplacer()
+		r := httptest.NewRequest(http.MethodGet, "/test.png", nil)
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+		w := httptest.NewRecorder()
+		src := io.NopCloser(bytes.NewReader(testPNG(t, 20, 10)))
+
+		_ = img.process(w, r, repl, src, "test.png", func() {}, nil)
+		if filter.sleep > 0 {
+			// caddy keeps using the replacer while the timed out worker is still running
+			for i := 0; i < 1000; i++ {
+				repl.Set("http.error.status_code", i)
+			}
+		}
+
+		if got := <-filter.width; got != 20 {
+			t.Errorf("timeout %v: width from the request's replacer = %v, want 20", timeout, got)
+		}
+	}
+}
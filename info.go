@@ -0,0 +1,251 @@
+package imagefilter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/disintegration/imaging"
+	"go.uber.org/zap"
+)
+
+// Possible values of ImageFilter.Output.
+const (
+	outputImage = "image"
+	outputInfo  = "info"
+)
+
+// Fields of the info output (see ImageFilter.InfoFields).
+const (
+	infoWidth         = "width"
+	infoHeight        = "height"
+	infoFormat        = "format"
+	infoSize          = "size"
+	infoOrientation   = "orientation"
+	infoAlpha         = "alpha"
+	infoDominantColor = "dominant_color"
+)
+
+// infoFields are all fields of the info output. The fields that require decoding the whole image
+// are true.
+var infoFields = map[string]bool{
+	infoWidth:         false,
+	infoHeight:        false,
+	infoFormat:        false,
+	infoSize:          false,
+	infoOrientation:   false,
+	infoAlpha:         true,
+	infoDominantColor: true,
+}
+
+// exifHeaderSize is the number of bytes, that are searched for the EXIF orientation.
+const exifHeaderSize = 64 << 10
+
+// validateInfo validates the configuration of the info output.
+func (img *ImageFilter) validateInfo() error {
+	if img.Source != sourceFile {
+		return fmt.Errorf("output info cannot be used with source '%s'", img.Source)
+	}
+	if len(img.filters) > 0 || len(img.Variants) > 0 {
+		return fmt.Errorf("output info cannot be used with image filters or variants")
+	}
+	for _, field := range img.InfoFields {
+		if _, ok := infoFields[field]; !ok {
+			return fmt.Errorf("unknown info field '%s'", field)
+		}
+	}
+	return nil
+}
+
+// serveInfo responds with information about the source image as JSON. The image is only decoded
+// completely if a requested field requires it, otherwise only the header is read.
+func (img *ImageFilter) serveInfo(w http.ResponseWriter, repl *caddy.Replacer, file io.Reader, info fs.FileInfo) error {
+	fields := img.InfoFields
+	if len(fields) == 0 {
+		fields = []string{infoWidth, infoHeight, infoFormat, infoSize, infoOrientation, infoAlpha, infoDominantColor}
+	}
+	decode := false
+	for _, field := range fields {
+		decode = decode || infoFields[field]
+	}
+
+	br := bufio.NewReaderSize(file, exifHeaderSize)
+	header, _ := br.Peek(exifHeaderSize)
+	orientation := exifOrientation(header)
+
+	var width, height int
+	var formatName string
+	var decoded image.Image
+	if decode {
+		var err error
+		decoded, formatName, err = image.Decode(br)
+		if err != nil {
+			imageFilterMetrics.errors.WithLabelValues(errorKindDecode).Inc()
+			return caddyhttp.Error(http.StatusUnsupportedMediaType, err)
+		}
+		width, height = decoded.Bounds().Dx(), decoded.Bounds().Dy()
+	} else {
+		cfg, name, err := image.DecodeConfig(br)
+		if err != nil {
+			imageFilterMetrics.errors.WithLabelValues(errorKindDecode).Inc()
+			return caddyhttp.Error(http.StatusUnsupportedMediaType, err)
+		}
+		width, height, formatName = cfg.Width, cfg.Height, name
+	}
+
+	result := make(map[string]any, len(fields))
+	for _, field := range fields {
+		switch field {
+		case infoWidth:
+			result[field] = width
+		case infoHeight:
+			result[field] = height
+		case infoFormat:
+			result[field] = formatName
+		case infoSize:
+			result[field] = info.Size()
+		case infoOrientation:
+			result[field] = orientation
+		case infoAlpha:
+			result[field] = hasAlpha(decoded)
+		case infoDominantColor:
+			result[field] = dominantColor(decoded)
+		}
+	}
+
+	repl.Set("http.image_filter.source_width", width)
+	repl.Set("http.image_filter.source_height", height)
+	repl.Set("http.image_filter.source_format", formatName)
+
+	img.setCacheControl(w, repl, false)
+	setContentType(w, "json")
+	err := json.NewEncoder(w).Encode(result)
+	if err != nil {
+		img.logger.Error("failed to write info", zap.Error(err))
+	}
+	return nil
+}
+
+// exifOrientation returns the EXIF orientation (1-8) of a JPEG image from its first bytes. It's 1
+// if there is no orientation.
+func exifOrientation(header []byte) int {
+	if len(header) < 4 || header[0] != 0xFF || header[1] != 0xD8 {
+		return 1
+	}
+	pos := 2
+	for pos+4 <= len(header) {
+		if header[pos] != 0xFF {
+			return 1
+		}
+		marker := header[pos+1]
+		size := int(binary.BigEndian.Uint16(header[pos+2:]))
+		if marker == 0xDA || size < 2 { // start of scan, no more metadata
+			return 1
+		}
+		end := pos + 2 + size
+		if end > len(header) {
+			return 1
+		}
+		if marker == 0xE1 && size > 8 && string(header[pos+4:pos+10]) == "Exif\x00\x00" {
+			return tiffOrientation(header[pos+10 : end])
+		}
+		pos = end
+	}
+	return 1
+}
+
+// tiffOrientation returns the orientation tag of the first IFD of TIFF encoded EXIF data.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// hasAlpha reports whether the image has transparent pixels.
+func hasAlpha(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return !o.Opaque()
+	}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xFFFF {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dominantColor returns the most frequent color of the image as hex string, e.g. "#aa5500".
+// Colors are grouped by the 4 most significant bits of each channel and transparent pixels are
+// ignored.
+func dominantColor(img image.Image) string {
+	thumb := imaging.Fit(img, 100, 100, imaging.Box)
+
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+	buckets := make(map[int]*bucket)
+	var best *bucket
+	for i := 0; i+3 < len(thumb.Pix); i += 4 {
+		r, g, b, a := int(thumb.Pix[i]), int(thumb.Pix[i+1]), int(thumb.Pix[i+2]), thumb.Pix[i+3]
+		if a < 128 {
+			continue
+		}
+		key := (r>>4)<<8 | (g>>4)<<4 | b>>4
+		bk, ok := buckets[key]
+		if !ok {
+			bk = new(bucket)
+			buckets[key] = bk
+		}
+		bk.count++
+		bk.r += r
+		bk.g += g
+		bk.b += b
+		if best == nil || bk.count > best.count {
+			best = bk
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.count, best.g/best.count, best.b/best.count)
+}
@@ -0,0 +1,158 @@
+package imagefilter
+
+import (
+	"io"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Kinds of errors that are counted.
+const (
+	errorKindNotFound = "not_found"
+	errorKindDecode   = "decode"
+	errorKindFilter   = "filter"
+	errorKindEncode   = "encode"
+	errorKindTimeout  = "timeout"
+	errorKindCanceled = "canceled"
+	errorKindOrigin   = "origin"
+	errorKindDenied   = "denied"
+)
+
+// Results of filters that are observed.
+const (
+	filterResultOK    = "ok"
+	filterResultError = "error"
+)
+
+var imageFilterMetrics = struct {
+	init           sync.Once
+	decodeDuration *prometheus.HistogramVec
+	filterDuration *prometheus.HistogramVec
+	encodeDuration *prometheus.HistogramVec
+	inputBytes     prometheus.Histogram
+	outputBytes    prometheus.Histogram
+	inputPixels    prometheus.Histogram
+	outputPixels   prometheus.Histogram
+	semaphoreWait  prometheus.Histogram
+	queueDepth     prometheus.Gauge
+	inFlight       prometheus.Gauge
+	errors         *prometheus.CounterVec
+	cacheRequests  *prometheus.CounterVec
+}{}
+
+// initImageFilterMetrics registers the metrics with caddy's metrics registry.
+func initImageFilterMetrics() {
+	const ns, sub = "caddy", "image_filter"
+
+	durationBuckets := prometheus.ExponentialBuckets(0.001, 2, 15)
+	sizeBuckets := prometheus.ExponentialBuckets(1024, 4, 10)
+	pixelBuckets := prometheus.ExponentialBuckets(10_000, 4, 10)
+
+	imageFilterMetrics.decodeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "decode_duration_seconds",
+		Help:      "Time spent decoding source images.",
+		Buckets:   durationBuckets,
+	}, []string{"format"})
+	imageFilterMetrics.filterDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "filter_duration_seconds",
+		Help:      "Time spent applying image filters, including failed ones.",
+		Buckets:   durationBuckets,
+	}, []string{"filter", "result"})
+	imageFilterMetrics.encodeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "encode_duration_seconds",
+		Help:      "Time spent encoding filtered images.",
+		Buckets:   durationBuckets,
+	}, []string{"format"})
+	imageFilterMetrics.inputBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "input_bytes",
+		Help:      "Size of source image files.",
+		Buckets:   sizeBuckets,
+	})
+	imageFilterMetrics.outputBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "output_bytes",
+		Help:      "Size of encoded filtered images.",
+		Buckets:   sizeBuckets,
+	})
+	imageFilterMetrics.inputPixels = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "input_pixels",
+		Help:      "Number of pixels of decoded source images.",
+		Buckets:   pixelBuckets,
+	})
+	imageFilterMetrics.outputPixels = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "output_pixels",
+		Help:      "Number of pixels of filtered images.",
+		Buckets:   pixelBuckets,
+	})
+	imageFilterMetrics.semaphoreWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "semaphore_wait_seconds",
+		Help:      "Time requests waited for a free slot (see max_concurrent).",
+		Buckets:   durationBuckets,
+	})
+	imageFilterMetrics.queueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "queue_depth",
+		Help:      "Number of requests currently waiting for a free slot (see max_concurrent).",
+	})
+	imageFilterMetrics.inFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "in_flight",
+		Help:      "Number of images currently processed.",
+	})
+	imageFilterMetrics.errors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "errors_total",
+		Help:      "Number of errors by kind.",
+	}, []string{"kind"})
+	imageFilterMetrics.cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "cache_requests_total",
+		Help:      "Number of source images fetched from the origin by cache result (hit, revalidated or miss).",
+	}, []string{"result"})
+}
+
+// filterName returns the module name of the filter for metrics and logs.
+func filterName(filter ContextFilter) string {
+	var mod any = filter
+	if fa, ok := filter.(filterAdapter); ok {
+		mod = fa.Filter
+	}
+	if m, ok := mod.(caddy.Module); ok {
+		return m.CaddyModule().ID.Name()
+	}
+	return "unknown"
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
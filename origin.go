@@ -0,0 +1,463 @@
+package imagefilter
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// Defaults of Origin.
+const (
+	defaultOriginTimeout   = caddy.Duration(10 * time.Second)
+	defaultOriginMaxSize   = 32 << 20
+	defaultOriginCacheSize = 64 << 20
+)
+
+// Results of the cache of source images (see {http.image_filter.cache}).
+const (
+	cacheHit         = "hit"
+	cacheRevalidated = "revalidated"
+	cacheMiss        = "miss"
+	cacheNone        = "none" // sources without a cache
+)
+
+// Origin fetches source images over HTTP (see ImageFilter.Source).
+type Origin struct {
+	// URL is the URL of the source image. It should contain placeholders, e.g.
+	// "http://images.internal{http.request.uri.path}".
+	URL string `json:"url,omitempty"`
+
+	// Timeout bounds the time of fetching a source image. Default is 10s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// MaxSize is the maximum size of a source image in bytes. Default is 32 MiB.
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// AllowedHosts are the hosts, source images can be fetched from. It's required if the host of
+	// the URL starts with a placeholder, otherwise it defaults to the host of the URL.
+	AllowedHosts []string `json:"allowed_hosts,omitempty"`
+
+	// CacheSize is the size in bytes of the in-memory cache of source images. Cached images are
+	// used without a request as long as they are fresh according to the max-age of their
+	// Cache-Control header. After that, images with an ETag or Last-Modified header are
+	// revalidated with a conditional request instead of being fetched again. Default is 64 MiB.
+	CacheSize int64 `json:"cache_size,omitempty"`
+
+	client *http.Client
+	cache  *originCache
+}
+
+// unmarshalOrigin parses the origin subdirective.
+//
+// Syntax:
+//
+//	origin <url-template> {
+//	    timeout       <duration>
+//	    max_size      <size>
+//	    allowed_hosts <hosts...>
+//	    cache_size    <size>
+//	}
+func unmarshalOrigin(d *caddyfile.Dispenser) (*Origin, error) {
+	o := new(Origin)
+	if !d.Args(&o.URL) {
+		return nil, d.ArgErr()
+	}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "timeout":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid timeout: %v", err)
+			}
+			o.Timeout = caddy.Duration(dur)
+
+		case "max_size", "cache_size":
+			name := d.Val()
+			var sizeStr string
+			if !d.AllArgs(&sizeStr) {
+				return nil, d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(sizeStr)
+			if err != nil {
+				return nil, d.Errf("invalid %s: %v", name, err)
+			}
+			if name == "max_size" {
+				o.MaxSize = int64(size)
+			} else {
+				o.CacheSize = int64(size)
+			}
+
+		case "allowed_hosts":
+			hosts := d.RemainingArgs()
+			if len(hosts) == 0 {
+				return nil, d.ArgErr()
+			}
+			o.AllowedHosts = append(o.AllowedHosts, hosts...)
+
+		default:
+			return nil, d.Errf("unrecognized origin subdirective '%s'", d.Val())
+		}
+	}
+	return o, nil
+}
+
+// provision sets the defaults and creates the HTTP client.
+func (o *Origin) provision() {
+	if o.Timeout == 0 {
+		o.Timeout = defaultOriginTimeout
+	}
+	if o.MaxSize == 0 {
+		o.MaxSize = defaultOriginMaxSize
+	}
+	if o.CacheSize == 0 {
+		o.CacheSize = defaultOriginCacheSize
+	}
+	if len(o.AllowedHosts) == 0 {
+		if host, ok := staticHost(o.URL); ok {
+			o.AllowedHosts = []string{host}
+		}
+	}
+
+	o.client = &http.Client{
+		Timeout: time.Duration(o.Timeout),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return o.checkURL(req.URL)
+		},
+	}
+	o.cache = newOriginCache(o.CacheSize)
+}
+
+// validate validates the configuration.
+func (o *Origin) validate() error {
+	if o.URL == "" {
+		return errors.New("origin url is required")
+	}
+	if len(o.AllowedHosts) == 0 {
+		return errors.New("origin allowed_hosts is required, if the host of the url starts with a placeholder")
+	}
+	if o.Timeout < 0 || o.MaxSize < 0 || o.CacheSize < 0 {
+		return errors.New("origin timeout, max_size and cache_size must be greater or equal 0")
+	}
+	return nil
+}
+
+// staticHost returns the host name of an URL template up to the first placeholder, if the scheme
+// contains no placeholders and the host doesn't start with one. Requests are checked against the
+// allowed hosts anyway, so a placeholder that continues the host name only leads to forbidden
+// requests.
+func staticHost(template string) (string, bool) {
+	scheme, rest, found := strings.Cut(template, "://")
+	if !found || HasPlaceholder(scheme) {
+		return "", false
+	}
+	host := rest
+	if i := strings.IndexAny(rest, "/?#{"); i >= 0 {
+		host = rest[:i]
+	}
+	u, err := url.Parse(scheme + "://" + host)
+	if err != nil || u.Hostname() == "" {
+		return "", false
+	}
+	return u.Hostname(), true
+}
+
+// checkURL checks that source images can be fetched from the URL.
+func (o *Origin) checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme '%s' not allowed", u.Scheme)
+	}
+	for _, host := range o.AllowedHosts {
+		if strings.EqualFold(u.Hostname(), host) {
+			return nil
+		}
+	}
+	return fmt.Errorf("host '%s' not allowed", u.Hostname())
+}
+
+// fetch returns the source image at the URL and whether it was a cache hit, revalidated or a
+// miss. Cached images are used while they are fresh and revalidated with a conditional request
+// afterwards.
+func (o *Origin) fetch(ctx context.Context, rawURL string) (*originEntry, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	err = o.checkURL(u)
+	if err != nil {
+		return nil, "", caddyhttp.Error(http.StatusForbidden, err)
+	}
+
+	cached := o.cache.get(u.String())
+	now := time.Now()
+	if cached != nil && now.Before(cached.expires) {
+		return cached, cacheHit, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) && urlErr.Timeout() {
+			return nil, "", caddyhttp.Error(http.StatusGatewayTimeout, err)
+		}
+		return nil, "", caddyhttp.Error(http.StatusBadGateway, err)
+	}
+	defer resp.Body.Close()
+
+	expires, store := freshness(resp.Header, now)
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		if !expires.IsZero() {
+			refreshed := *cached
+			refreshed.expires = expires
+			o.cache.put(&refreshed)
+			return &refreshed, cacheRevalidated, nil
+		}
+		return cached, cacheRevalidated, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, "", caddyhttp.Error(http.StatusNotFound, fmt.Errorf("origin responded with %s", resp.Status))
+	case resp.StatusCode != http.StatusOK:
+		return nil, "", caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("origin responded with %s", resp.Status))
+	case resp.ContentLength > o.MaxSize:
+		return nil, "", caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("origin response too large: %d bytes", resp.ContentLength))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, o.MaxSize+1))
+	if err != nil {
+		return nil, "", caddyhttp.Error(http.StatusBadGateway, err)
+	}
+	if int64(len(body)) > o.MaxSize {
+		return nil, "", caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("origin response too large: more than %d bytes", o.MaxSize))
+	}
+
+	entry := &originEntry{
+		url:          u.String(),
+		body:         body,
+		contentType:  resp.Header.Get("Content-Type"),
+		etag:         resp.Header.Get("Etag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		expires:      expires,
+	}
+	if store && (entry.etag != "" || entry.lastModified != "" || !entry.expires.IsZero()) {
+		o.cache.put(entry)
+	} else {
+		o.cache.remove(entry.url)
+	}
+	return entry, cacheMiss, nil
+}
+
+// freshness returns until when a response can be used without revalidation according to the
+// max-age of its Cache-Control header, or the zero time if it has to be revalidated. store is
+// false if the response must not be cached at all.
+func freshness(header http.Header, now time.Time) (expires time.Time, store bool) {
+	store = true
+	maxAge := -1
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store":
+			store = false
+		case "no-cache":
+			maxAge = 0
+		case "max-age":
+			if v, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && v > 0 && maxAge != 0 {
+				maxAge = v
+			}
+		}
+	}
+	if !store || maxAge <= 0 {
+		return time.Time{}, store
+	}
+	return now.Add(time.Duration(maxAge) * time.Second), true
+}
+
+// serveOrigin fetches the source image from the origin and filters it.
+func (img *ImageFilter) serveOrigin(w http.ResponseWriter, r *http.Request, repl *caddy.Replacer) error {
+	rawURL := repl.ReplaceAll(img.Origin.URL, "")
+
+	ctx, span := startSpan(r.Context(), "Origin.Fetch", attribute.String("image_filter.url", rawURL))
+	entry, cacheResult, err := img.Origin.fetch(ctx, rawURL)
+	if err == nil {
+		span.SetAttributes(attribute.String("image_filter.cache", cacheResult))
+	}
+	endSpan(span, err)
+	if err != nil {
+		imageFilterMetrics.errors.WithLabelValues(errorKindOrigin).Inc()
+		return err
+	}
+	imageFilterMetrics.cacheRequests.WithLabelValues(cacheResult).Inc()
+	repl.Set("http.image_filter.cache", cacheResult)
+	imageFilterMetrics.inputBytes.Observe(float64(len(entry.body)))
+
+	path := "/"
+	if u, err := url.Parse(entry.url); err == nil && u.Path != "" {
+		path = u.Path
+	}
+	img.setCacheKey(repl, entry.url, entry.identity())
+	if img.SurrogateKeys {
+		setSurrogateKeys(w, path)
+	}
+
+	release, err := img.reserve(r.Context())
+	if err != nil {
+		return err
+	}
+	src := io.NopCloser(bytes.NewReader(entry.body))
+	return img.process(w, r, repl, src, entry.url, release, func() error {
+		if entry.contentType != "" {
+			w.Header().Set("Content-Type", entry.contentType)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(entry.body)))
+		_, err := w.Write(entry.body)
+		if err != nil {
+			img.logger.Error("failed to write image", zap.Error(err))
+		}
+		return nil
+	})
+}
+
+// originEntry is a source image fetched from the origin.
+type originEntry struct {
+	url          string
+	body         []byte
+	contentType  string
+	etag         string
+	lastModified string
+	expires      time.Time
+}
+
+// identity returns the identity of the source image for the cache key.
+func (e *originEntry) identity() string {
+	if e.etag != "" {
+		return e.etag
+	}
+	sum := sha256.Sum256(e.body)
+	return hex.EncodeToString(sum[:])
+}
+
+// originCache is an in-memory LRU cache of source images, that is limited by the total size of
+// the images.
+type originCache struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+func newOriginCache(maxSize int64) *originCache {
+	return &originCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached source image of the URL or nil.
+func (c *originCache) get(url string) *originEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[url]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*originEntry)
+}
+
+// put adds a source image and removes the least recently used ones, if the cache is full.
+func (c *originCache) put(entry *originEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(entry.url)
+	if int64(len(entry.body)) > c.maxSize {
+		return
+	}
+
+	c.entries[entry.url] = c.lru.PushFront(entry)
+	c.size += int64(len(entry.body))
+	for c.size > c.maxSize {
+		c.removeLocked(c.lru.Back().Value.(*originEntry).url)
+	}
+}
+
+// purge removes the source images, whose URL or URL path starts with the prefix, or all source
+// images if the prefix is empty. It returns the number of removed images.
+func (c *originCache) purge(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var urls []string
+	for rawURL := range c.entries {
+		if matchSourcePrefix(rawURL, prefix) {
+			urls = append(urls, rawURL)
+		}
+	}
+	for _, rawURL := range urls {
+		c.removeLocked(rawURL)
+	}
+	return len(urls)
+}
+
+// stats returns the number of cached source images and their total size in bytes.
+func (c *originCache) stats() (int, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries), c.size
+}
+
+// remove removes the source image of the URL.
+func (c *originCache) remove(url string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(url)
+}
+
+func (c *originCache) removeLocked(url string) {
+	elem, ok := c.entries[url]
+	if !ok {
+		return
+	}
+	c.lru.Remove(elem)
+	delete(c.entries, url)
+	c.size -= int64(len(elem.Value.(*originEntry).body))
+}
@@ -0,0 +1,283 @@
+package imagefilter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// newTestOrigin returns an origin, that is allowed to fetch from the server.
+func newTestOrigin(t *testing.T, srv *httptest.Server) *Origin {
+	t.Helper()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &Origin{URL: srv.URL + "{http.request.uri.path}", AllowedHosts: []string{u.Hostname()}}
+	o.provision()
+	return o
+}
+
+// expectStatus checks that err is a handler error with the status code.
+func expectStatus(t *testing.T, err error, status int) {
+	t.Helper()
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != status {
+		t.Errorf("expected status %d, got %v", status, err)
+	}
+}
+
+func TestOriginAllowedHosts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect-allowed":
+			http.Redirect(w, r, "/image.png", http.StatusFound)
+		case "/redirect-forbidden":
+			// same server, but a host name that is not allowed
+			http.Redirect(w, r, "http://"+strings.Replace(r.Host, "127.0.0.1", "localhost", 1)+"/image.png", http.StatusFound)
+		default:
+			_, _ = w.Write([]byte("image"))
+		}
+	}))
+	defer srv.Close()
+	o := newTestOrigin(t, srv)
+	ctx := context.Background()
+
+	entry, _, err := o.fetch(ctx, srv.URL+"/image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(entry.body) != "image" {
+		t.Errorf("body = %q, want %q", entry.body, "image")
+	}
+
+	_, _, err = o.fetch(ctx, strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)+"/image.png")
+	expectStatus(t, err, http.StatusForbidden)
+
+	_, _, err = o.fetch(ctx, "file:///etc/passwd")
+	expectStatus(t, err, http.StatusForbidden)
+
+	entry, _, err = o.fetch(ctx, srv.URL+"/redirect-allowed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(entry.body) != "image" {
+		t.Errorf("body after redirect = %q, want %q", entry.body, "image")
+	}
+
+	_, _, err = o.fetch(ctx, srv.URL+"/redirect-forbidden")
+	expectStatus(t, err, http.StatusBadGateway)
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("expected redirect to be rejected by the allowed hosts, got %v", err)
+	}
+}
+
+func TestOriginMaxSize(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			// flushing before writing the body omits the Content-Length header
+			w.(http.Flusher).Flush()
+		} else {
+			w.Header().Set("Content-Length", "100")
+		}
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	for _, path := range []string{"/content-length", "/chunked"} {
+		o := newTestOrigin(t, srv)
+		o.MaxSize = 99
+		_, _, err := o.fetch(ctx, srv.URL+path)
+		expectStatus(t, err, http.StatusBadGateway)
+		if err == nil || !strings.Contains(err.Error(), "too large") {
+			t.Errorf("%s: expected response to be too large, got %v", path, err)
+		}
+
+		o.MaxSize = 100
+		entry, _, err := o.fetch(ctx, srv.URL+path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if len(entry.body) != 100 {
+			t.Errorf("%s: got %d bytes, want 100", path, len(entry.body))
+		}
+	}
+}
+
+func TestOriginRevalidation(t *testing.T) {
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	var requests, notModified atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/etag":
+			w.Header().Set("Etag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				notModified.Add(1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/last-modified":
+			w.Header().Set("Last-Modified", lastModified)
+			if r.Header.Get("If-Modified-Since") == lastModified {
+				notModified.Add(1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		_, _ = w.Write([]byte("image" + r.URL.Path))
+	}))
+	defer srv.Close()
+	o := newTestOrigin(t, srv)
+	ctx := context.Background()
+
+	for _, path := range []string{"/etag", "/last-modified"} {
+		first, result, err := o.fetch(ctx, srv.URL+path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != cacheMiss {
+			t.Errorf("%s: first result = %q, want %q", path, result, cacheMiss)
+		}
+		second, result, err := o.fetch(ctx, srv.URL+path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != cacheRevalidated {
+			t.Errorf("%s: second result = %q, want %q", path, result, cacheRevalidated)
+		}
+		if second != first {
+			t.Errorf("%s: revalidated image is not the cached entry", path)
+		}
+		if string(second.body) != "image"+path {
+			t.Errorf("%s: body = %q", path, second.body)
+		}
+	}
+	if requests.Load() != 4 || notModified.Load() != 2 {
+		t.Errorf("got %d requests and %d not modified responses, want 4 and 2", requests.Load(), notModified.Load())
+	}
+
+	// images without validators are not cached
+	first, _, err := o.fetch(ctx, srv.URL+"/none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := o.fetch(ctx, srv.URL+"/none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Error("image without ETag or Last-Modified was cached")
+	}
+	if notModified.Load() != 2 {
+		t.Errorf("got %d not modified responses, want 2", notModified.Load())
+	}
+}
+
+func TestOriginFreshness(t *testing.T) {
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/max-age":
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Etag", `"v1"`)
+		}
+		_, _ = w.Write([]byte("image"))
+	}))
+	defer srv.Close()
+	o := newTestOrigin(t, srv)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		path     string
+		results  []string
+		requests int64
+	}{
+		{path: "/max-age", results: []string{cacheMiss, cacheHit}, requests: 1},
+		{path: "/no-store", results: []string{cacheMiss, cacheMiss}, requests: 2},
+	} {
+		requests.Store(0)
+		for i, want := range tc.results {
+			_, result, err := o.fetch(ctx, srv.URL+tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != want {
+				t.Errorf("%s: result %d = %q, want %q", tc.path, i, result, want)
+			}
+		}
+		if requests.Load() != tc.requests {
+			t.Errorf("%s: got %d requests, want %d", tc.path, requests.Load(), tc.requests)
+		}
+	}
+}
+
+func TestCachePlaceholder(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = w.Write(testPNG(t, 20, 10))
+	}))
+	defer srv.Close()
+	root := t.TempDir()
+	err := os.WriteFile(filepath.Join(root, "test.png"), testPNG(t, 20, 10), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(img *ImageFilter) any {
+		t.Helper()
+		repl := caddy.NewReplacer()
+		r := httptest.NewRequest(http.MethodGet, "/test.png", nil)
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			http.ServeFile(w, r, filepath.Join(root, "test.png"))
+			return nil
+		})
+		err := img.ServeHTTP(httptest.NewRecorder(), r, next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := repl.Get("http.image_filter.output_width"); got != 20 {
+			t.Fatalf("source %s: image was not filtered", img.Source)
+		}
+		result, _ := repl.Get("http.image_filter.cache")
+		return result
+	}
+
+	origin := newTestImageFilter(testFilter{})
+	origin.Source = sourceOrigin
+	origin.Origin = newTestOrigin(t, srv)
+	for _, want := range []string{cacheMiss, cacheHit} {
+		if got := serve(origin); got != want {
+			t.Errorf("source origin: cache = %v, want %q", got, want)
+		}
+	}
+
+	file := newTestImageFilter(testFilter{})
+	file.Source = sourceFile
+	file.Root = root
+	file.fileSystem = osFS{}
+	response := newTestImageFilter(testFilter{})
+	response.Source = sourceResponse
+	response.MaxResponseSize = defaultMaxResponseSize
+	for _, img := range []*ImageFilter{file, response} {
+		if got := serve(img); got != cacheNone {
+			t.Errorf("source %s: cache = %v, want %q", img.Source, got, cacheNone)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package params
+
+import (
+	"errors"
+
+	"github.com/disintegration/imaging"
+)
+
+// Anchor is an anchor point of an image. Possible values are: center, topleft, top, topright,
+// left, right, bottomleft, bottom, bottomright. An empty argument is center.
+type Anchor struct {
+	param[imaging.Anchor]
+}
+
+// NewAnchor creates an anchor parameter.
+func NewAnchor(name, arg string) (Anchor, error) {
+	p, err := newParam(name, arg, parseAnchor, nil)
+	return Anchor{p}, err
+}
+
+func parseAnchor(arg string) (imaging.Anchor, error) {
+	switch arg {
+	case "", "center":
+		return imaging.Center, nil
+	case "topleft":
+		return imaging.TopLeft, nil
+	case "top":
+		return imaging.Top, nil
+	case "topright":
+		return imaging.TopRight, nil
+	case "left":
+		return imaging.Left, nil
+	case "right":
+		return imaging.Right, nil
+	case "bottomleft":
+		return imaging.BottomLeft, nil
+	case "bottom":
+		return imaging.Bottom, nil
+	case "bottomright":
+		return imaging.BottomRight, nil
+	default:
+		return imaging.Center, errors.New("unknown anchor")
+	}
+}
@@ -0,0 +1,130 @@
+package params
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// evalExpr evaluates a simple arithmetic expression like "(1200-40)/2". Supported are floating
+// point numbers, the operators +, -, *, / and parentheses.
+func evalExpr(s string) (float64, error) {
+	p := &exprParser{s: s}
+	v, err := p.expr()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.s) {
+		return 0, fmt.Errorf("unexpected '%c' at position %d", p.s[p.pos], p.pos)
+	}
+	return v, nil
+}
+
+// exprParser is a recursive descent parser for arithmetic expressions.
+type exprParser struct {
+	s   string
+	pos int
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// peek returns the next non-space character or 0 at the end of the input.
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+// expr = term { ("+" | "-") term }
+func (p *exprParser) expr() (float64, error) {
+	v, err := p.term()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return v, nil
+		}
+		p.pos++
+		w, err := p.term()
+		if err != nil {
+			return 0, err
+		}
+		if op == '+' {
+			v += w
+		} else {
+			v -= w
+		}
+	}
+}
+
+// term = factor { ("*" | "/") factor }
+func (p *exprParser) term() (float64, error) {
+	v, err := p.factor()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' {
+			return v, nil
+		}
+		p.pos++
+		w, err := p.factor()
+		if err != nil {
+			return 0, err
+		}
+		if op == '*' {
+			v *= w
+		} else {
+			if w == 0 {
+				return 0, errors.New("division by zero")
+			}
+			v /= w
+		}
+	}
+}
+
+// factor = ("+" | "-") factor | "(" expr ")" | number
+func (p *exprParser) factor() (float64, error) {
+	switch p.peek() {
+	case '+':
+		p.pos++
+		return p.factor()
+	case '-':
+		p.pos++
+		v, err := p.factor()
+		return -v, err
+	case '(':
+		p.pos++
+		v, err := p.expr()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, errors.New("missing ')'")
+		}
+		p.pos++
+		return v, nil
+	case 0:
+		return 0, errors.New("unexpected end of expression")
+	}
+
+	start := p.pos
+	for p.pos < len(p.s) && strings.IndexByte("0123456789.", p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+	if start == p.pos {
+		return 0, fmt.Errorf("unexpected '%c' at position %d", p.s[p.pos], p.pos)
+	}
+	return strconv.ParseFloat(p.s[start:p.pos], 64)
+}
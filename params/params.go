@@ -0,0 +1,154 @@
+// Package params provides typed filter arguments, that can contain caddy placeholders. Arguments
+// without placeholders are parsed and checked once when the parameter is created (at provision
+// time), arguments with placeholders every time the value is requested.
+//
+// Numeric arguments can also be simple arithmetic expressions with +, -, *, / and parentheses, e.g.
+// "{image_filter.width}/2".
+package params
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	imagefilter "github.com/ueffel/caddy-imagefilter/v2"
+)
+
+// Check is a range check for a parsed parameter value.
+type Check[T any] func(T) error
+
+// Min checks that a value is greater or equal min.
+func Min[T int | float64](min T) Check[T] {
+	return func(v T) error {
+		if v < min {
+			return fmt.Errorf("must be greater or equal %v", min)
+		}
+		return nil
+	}
+}
+
+// Greater checks that a value is greater than limit.
+func Greater[T int | float64](limit T) Check[T] {
+	return func(v T) error {
+		if v <= limit {
+			return fmt.Errorf("must be greater than %v", limit)
+		}
+		return nil
+	}
+}
+
+// OneOf checks that a value is one of the allowed values.
+func OneOf[T comparable](allowed ...T) Check[T] {
+	return func(v T) error {
+		for _, a := range allowed {
+			if v == a {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %v", allowed)
+	}
+}
+
+// param is a filter argument of type T.
+type param[T any] struct {
+	name   string
+	raw    string
+	parse  func(string) (T, error)
+	checks []Check[T]
+	value  T
+	static bool
+}
+
+// newParam creates the parameter and parses the argument if it contains no placeholders.
+func newParam[T any](name, raw string, parse func(string) (T, error), checks []Check[T]) (param[T], error) {
+	p := param[T]{name: name, raw: raw, parse: parse, checks: checks}
+	if imagefilter.HasPlaceholder(raw) {
+		return p, nil
+	}
+
+	value, err := p.parseAndCheck(raw)
+	if err != nil {
+		return p, err
+	}
+	p.value = value
+	p.static = true
+	return p, nil
+}
+
+// parseAndCheck parses the argument and applies all checks to the result.
+func (p param[T]) parseAndCheck(arg string) (T, error) {
+	value, err := p.parse(arg)
+	if err != nil {
+		return value, fmt.Errorf("invalid %s '%s': %w", p.name, arg, err)
+	}
+	for _, check := range p.checks {
+		err = check(value)
+		if err != nil {
+			return value, fmt.Errorf("invalid %s '%s': %w", p.name, arg, err)
+		}
+	}
+	return value, nil
+}
+
+// Value returns the value of the parameter. Placeholders are replaced with repl before parsing.
+func (p param[T]) Value(repl *caddy.Replacer) (T, error) {
+	if p.static {
+		return p.value, nil
+	}
+	return p.parseAndCheck(repl.ReplaceAll(p.raw, ""))
+}
+
+// StaticValue returns the value of the parameter and true, if the argument contains no
+// placeholders. Otherwise the second return value is false.
+func (p param[T]) StaticValue() (T, bool) {
+	return p.value, p.static
+}
+
+// Float is a floating point number. An empty argument is the default value.
+type Float struct {
+	param[float64]
+}
+
+// NewFloat creates a floating point parameter with a default value.
+func NewFloat(name, arg string, def float64, checks ...Check[float64]) (Float, error) {
+	parse := func(arg string) (float64, error) {
+		if arg == "" {
+			return def, nil
+		}
+		return parseNumber(arg)
+	}
+	p, err := newParam(name, arg, parse, checks)
+	return Float{p}, err
+}
+
+// Angle is an angle in degrees as floating point number.
+type Angle struct {
+	param[float64]
+}
+
+// NewAngle creates an angle parameter.
+func NewAngle(name, arg string, checks ...Check[float64]) (Angle, error) {
+	p, err := newParam(name, arg, parseAngle, checks)
+	return Angle{p}, err
+}
+
+func parseAngle(arg string) (float64, error) {
+	return parseNumber(arg)
+}
+
+// parseNumber parses a floating point number or an arithmetic expression (see evalExpr). Values,
+// that are not finite (NaN, Inf or out of range like 1e999), are rejected.
+func parseNumber(arg string) (float64, error) {
+	v, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		v, err = evalExpr(arg)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("%s is not a finite number", arg)
+	}
+	return v, nil
+}
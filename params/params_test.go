@@ -0,0 +1,33 @@
+package params
+
+import "testing"
+
+func TestParseNumber(t *testing.T) {
+	for _, tc := range []struct {
+		arg     string
+		want    float64
+		wantErr bool
+	}{
+		{arg: "1.5", want: 1.5},
+		{arg: "(1200-40)/2", want: 580},
+		{arg: "NaN", wantErr: true},
+		{arg: "nan", wantErr: true},
+		{arg: "Inf", wantErr: true},
+		{arg: "-Inf", wantErr: true},
+		{arg: "+infinity", wantErr: true},
+		{arg: "1e999", wantErr: true},
+		{arg: "1e308*10", wantErr: true},
+		{arg: "-1e308-1e308", wantErr: true},
+	} {
+		v, err := parseNumber(tc.arg)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseNumber(%q) = %v, expected error", tc.arg, v)
+			}
+			continue
+		}
+		if err != nil || v != tc.want {
+			t.Errorf("parseNumber(%q) = %v, %v, want %v", tc.arg, v, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package params
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	imagefilter "github.com/ueffel/caddy-imagefilter/v2"
+)
+
+// SizeOptions determines which forms of a size are accepted in addition to width and height.
+type SizeOptions struct {
+	// AutoDimension allows either width or height to be 0 (or empty), which means it is
+	// calculated from the other one preserving the aspect ratio.
+	AutoDimension bool
+
+	// AspectRatio allows an aspect ratio like "16:9" as width (with empty height). It resolves to
+	// the largest size with this aspect ratio that fits into the image.
+	AspectRatio bool
+
+	// Megapixels allows a megapixel budget like "2mp" as width (with empty height). It resolves to
+	// the largest size with the aspect ratio of the image that has at most this many pixels. Images
+	// that are already smaller keep their size.
+	Megapixels bool
+}
+
+// Size is the target size of an image given by a width and a height argument. Width and height
+// are pixels or percentages of the current image size like "50%". Depending on the SizeOptions,
+// the width argument can also be an aspect ratio or a megapixel budget. Sizes are resolved
+// against the bounds of the image, the filter is applied to.
+type Size struct {
+	width  string
+	height string
+	opts   SizeOptions
+	spec   sizeSpec
+	static bool
+}
+
+// sizeKind is the form of a size.
+type sizeKind int
+
+const (
+	sizeDimensions sizeKind = iota
+	sizeAspectRatio
+	sizeMegapixels
+)
+
+// sizeSpec is a parsed size.
+type sizeSpec struct {
+	kind   sizeKind
+	width  length
+	height length
+	ratio  float64
+	pixels float64
+}
+
+// length is an absolute or a relative (percentage) width or height.
+type length struct {
+	value   float64
+	percent bool
+}
+
+// pixels returns the length in pixels, percentages are relative to total.
+func (l length) pixels(total int) int {
+	if l.percent {
+		return int(math.Round(float64(total) * l.value / 100))
+	}
+	return int(math.Round(l.value))
+}
+
+// NewSize creates a size parameter from a width and a height argument.
+func NewSize(width, height string, opts SizeOptions) (Size, error) {
+	s := Size{width: width, height: height, opts: opts}
+	if imagefilter.HasPlaceholder(width) || imagefilter.HasPlaceholder(height) {
+		return s, nil
+	}
+
+	spec, err := s.parse(width, height)
+	if err != nil {
+		return s, err
+	}
+	s.spec = spec
+	s.static = true
+	return s, nil
+}
+
+// Resolve returns width and height in pixels for an image with the given bounds. Placeholders are
+// replaced with repl before parsing. A width or height of 0 is only returned with
+// SizeOptions.AutoDimension and has to be calculated by the filter.
+func (s Size) Resolve(repl *caddy.Replacer, bounds image.Rectangle) (int, int, error) {
+	spec := s.spec
+	if !s.static {
+		var err error
+		spec, err = s.parse(repl.ReplaceAll(s.width, ""), repl.ReplaceAll(s.height, ""))
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	dx, dy := bounds.Dx(), bounds.Dy()
+	switch spec.kind {
+	case sizeAspectRatio:
+		if float64(dx)/float64(dy) > spec.ratio {
+			return max(int(math.Round(float64(dy)*spec.ratio)), 1), dy, nil
+		}
+		return dx, max(int(math.Round(float64(dx)/spec.ratio)), 1), nil
+
+	case sizeMegapixels:
+		// a budget is a maximum, images are never enlarged to fill it
+		scale := min(math.Sqrt(spec.pixels/float64(dx*dy)), 1)
+		return max(int(float64(dx)*scale), 1), max(int(float64(dy)*scale), 1), nil
+
+	default:
+		width, height := spec.width.pixels(dx), spec.height.pixels(dy)
+		if !s.opts.AutoDimension {
+			return max(width, 1), max(height, 1), nil
+		}
+		if width == 0 && height == 0 {
+			return 0, 0, fmt.Errorf("invalid size %s %s: too small for image", s.width, s.height)
+		}
+		return width, height, nil
+	}
+}
+
+// parse parses width and height argument with placeholders already replaced.
+func (s Size) parse(width, height string) (sizeSpec, error) {
+	lower := strings.ToLower(width)
+	switch {
+	case s.opts.AspectRatio && strings.Contains(width, ":"):
+		if height != "" {
+			return sizeSpec{}, fmt.Errorf("invalid height '%s': not allowed with aspect ratio", height)
+		}
+		w, h, _ := strings.Cut(width, ":")
+		wv, err := parseNumber(w)
+		if err != nil {
+			return sizeSpec{}, fmt.Errorf("invalid aspect ratio '%s': %w", width, err)
+		}
+		hv, err := parseNumber(h)
+		if err != nil {
+			return sizeSpec{}, fmt.Errorf("invalid aspect ratio '%s': %w", width, err)
+		}
+		if wv <= 0 || hv <= 0 {
+			return sizeSpec{}, fmt.Errorf("invalid aspect ratio '%s': must be greater than 0", width)
+		}
+		return sizeSpec{kind: sizeAspectRatio, ratio: wv / hv}, nil
+
+	case s.opts.Megapixels && strings.HasSuffix(lower, "mp"):
+		if height != "" {
+			return sizeSpec{}, fmt.Errorf("invalid height '%s': not allowed with megapixels", height)
+		}
+		mp, err := parseNumber(strings.TrimSpace(lower[:len(lower)-2]))
+		if err != nil {
+			return sizeSpec{}, fmt.Errorf("invalid megapixels '%s': %w", width, err)
+		}
+		if mp <= 0 {
+			return sizeSpec{}, fmt.Errorf("invalid megapixels '%s': must be greater than 0", width)
+		}
+		return sizeSpec{kind: sizeMegapixels, pixels: mp * 1e6}, nil
+	}
+
+	w, err := s.parseLength("width", width)
+	if err != nil {
+		return sizeSpec{}, err
+	}
+	h, err := s.parseLength("height", height)
+	if err != nil {
+		return sizeSpec{}, err
+	}
+	if w.value == 0 && h.value == 0 {
+		return sizeSpec{}, errors.New("width and height cannot both be 0")
+	}
+	return sizeSpec{kind: sizeDimensions, width: w, height: h}, nil
+}
+
+// parseLength parses a width or height in pixels or percent.
+func (s Size) parseLength(name, arg string) (length, error) {
+	var l length
+	var err error
+	if strings.HasSuffix(arg, "%") {
+		l.percent = true
+		l.value, err = parseNumber(strings.TrimSpace(arg[:len(arg)-1]))
+	} else if arg != "" {
+		l.value, err = parseNumber(arg)
+	}
+	if err != nil {
+		return l, fmt.Errorf("invalid %s '%s': %w", name, arg, err)
+	}
+	if math.Abs(l.value) > math.MaxInt32 {
+		return l, fmt.Errorf("invalid %s '%s': out of range", name, arg)
+	}
+
+	if s.opts.AutoDimension && l.value < 0 {
+		return l, fmt.Errorf("invalid %s '%s': must be greater or equal 0", name, arg)
+	}
+	if !s.opts.AutoDimension && l.value <= 0 {
+		return l, fmt.Errorf("invalid %s '%s': must be greater than 0", name, arg)
+	}
+	return l, nil
+}
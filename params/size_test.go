@@ -0,0 +1,39 @@
+package params
+
+import (
+	"image"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestSizeResolveMegapixels(t *testing.T) {
+	size, err := NewSize("2mp", "", SizeOptions{Megapixels: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		bounds        image.Rectangle
+		width, height int
+	}{
+		{bounds: image.Rect(0, 0, 4000, 2000), width: 2000, height: 1000},
+		{bounds: image.Rect(0, 0, 1000, 500), width: 1000, height: 500},
+		{bounds: image.Rect(0, 0, 10, 10), width: 10, height: 10},
+	} {
+		width, height, err := size.Resolve(caddy.NewReplacer(), tc.bounds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if width != tc.width || height != tc.height {
+			t.Errorf("Resolve(%v) = %dx%d, want %dx%d", tc.bounds, width, height, tc.width, tc.height)
+		}
+	}
+}
+
+func TestSizeRange(t *testing.T) {
+	for _, arg := range []string{"1e300", "-1e300", "1e300%"} {
+		if _, err := NewSize(arg, "", SizeOptions{AutoDimension: true}); err == nil {
+			t.Errorf("NewSize(%q) was accepted", arg)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package imagefilter
+
+import (
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// resultPlaceholders are the placeholders set while filtering an image, that are copied to the
+// request's replacer after the worker is done (see workerReplacer).
+var resultPlaceholders = []string{
+	"image_filter.format",
+	"image_filter.source_width",
+	"image_filter.source_height",
+	"image_filter.width",
+	"image_filter.height",
+	"http.image_filter.source_width",
+	"http.image_filter.source_height",
+	"http.image_filter.source_format",
+	"http.image_filter.output_width",
+	"http.image_filter.output_height",
+	"http.image_filter.output_format",
+	"http.image_filter.filter_duration",
+	"http.image_filter.duration",
+	"http.image_filter.filter_errors",
+}
+
+// workerReplacer is the replacer of the worker in buffered mode. caddy.Replacer is not safe for
+// concurrent use and the worker may still be running after the handler returned because of the
+// timeout. Therefore, the worker sets values only in its own replacer and reads the values of the
+// request's replacer only until it's detached.
+type workerReplacer struct {
+	repl *caddy.Replacer
+
+	mu     sync.Mutex
+	parent *caddy.Replacer // nil after detach
+}
+
+// newWorkerReplacer returns a replacer, that falls back to the values of parent.
+func newWorkerReplacer(parent *caddy.Replacer) *workerReplacer {
+	wr := &workerReplacer{repl: caddy.NewReplacer(), parent: parent}
+	wr.repl.Map(wr.fromParent)
+	return wr
+}
+
+// fromParent provides the values of the request's replacer, as long as it's not detached.
+func (wr *workerReplacer) fromParent(key string) (any, bool) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	if wr.parent == nil {
+		return nil, false
+	}
+	return wr.parent.Get(key)
+}
+
+// detach stops reading values of the request's replacer. It waits for a running read to finish.
+func (wr *workerReplacer) detach() {
+	wr.mu.Lock()
+	wr.parent = nil
+	wr.mu.Unlock()
+}
+
+// merge copies the result placeholders to the request's replacer. It must only be called after
+// the worker is done.
+func (wr *workerReplacer) merge() {
+	wr.mu.Lock()
+	parent := wr.parent
+	wr.mu.Unlock()
+	if parent == nil {
+		return
+	}
+	for _, key := range resultPlaceholders {
+		if value, ok := wr.repl.Get(key); ok {
+			parent.Set(key, value)
+		}
+	}
+}
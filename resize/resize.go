@@ -1,14 +1,16 @@
 package resize
 
 import (
-	"fmt"
+	"context"
 	"image"
-	"strconv"
+	"math"
+	"net/http"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/disintegration/imaging"
 	imagefilter "github.com/ueffel/caddy-imagefilter/v2"
+	"github.com/ueffel/caddy-imagefilter/v2/params"
 )
 
 // Resize can downsize images. If upsizing of an image is detected, nothing will be done and
@@ -16,13 +18,16 @@ import (
 type Resize struct {
 	Width  string `json:"width,omitempty"`
 	Height string `json:"height,omitempty"`
+
+	size params.Size
 }
 
 // UnmarshalCaddyfile configures the Resize instance.
 //
 // Syntax:
 //
-//	resize <width> <height>
+//	resize <width> [<height>]
+//	resize <megapixels>mp
 //
 // Parameters:
 //
@@ -30,9 +35,13 @@ type Resize struct {
 //
 // height must be a positive integer and determines the maximum height.
 //
-// Either width or height can be 0, then the image aspect ratio is preserved.
+// Either width or height can be 0 (or height omitted), then the image aspect ratio is preserved.
+// Width and height can also be percentages of the image size like 50%.
+//
+// megapixels is the maximum number of pixels of the resized image in millions (e.g. 2mp), the image
+// aspect ratio is preserved.
 func (f *Resize) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	if d.CountRemainingArgs() < 2 {
+	if d.CountRemainingArgs() < 1 {
 		return imagefilter.ErrTooFewArgs
 	}
 	if d.CountRemainingArgs() > 2 {
@@ -41,37 +50,32 @@ func (f *Resize) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 	args := d.RemainingArgs()
 	f.Width = args[0]
-	f.Height = args[1]
+	if len(args) > 1 {
+		f.Height = args[1]
+	}
 
 	return nil
 }
 
+// Provision parses the arguments.
+func (f *Resize) Provision(ctx caddy.Context) error {
+	var err error
+	f.size, err = params.NewSize(f.Width, f.Height, params.SizeOptions{AutoDimension: true, Megapixels: true})
+	return err
+}
+
 // Apply applies the image filter to an image and returns the new image.
 func (f *Resize) Apply(repl *caddy.Replacer, img image.Image) (image.Image, error) {
-	var err error
-	var width int
-	widthRepl := repl.ReplaceAll(f.Width, "")
-	if widthRepl == "" {
-		width = 0
-	} else {
-		width, err = strconv.Atoi(widthRepl)
-		if err != nil {
-			return img, fmt.Errorf("invalid width: %w", err)
-		}
-	}
-	var height int
-	heightRepl := repl.ReplaceAll(f.Height, "")
-	if heightRepl == "" {
-		height = 0
-	} else {
-		height, err = strconv.Atoi(heightRepl)
-		if err != nil {
-			return img, fmt.Errorf("invalid height: %w", err)
-		}
-	}
+	return f.ApplyContext(context.Background(), nil, repl, img)
+}
 
-	if height < 0 || width < 0 || height == 0 && width == 0 {
-		return img, fmt.Errorf("invalid width height combination %d %d", width, height)
+// ApplyContext applies the image filter to an image and returns the new image. The image is
+// resized horizontally and vertically in separate passes (like imaging.Resize does), so it stops,
+// if the context is done between them.
+func (f *Resize) ApplyContext(ctx context.Context, _ *http.Request, repl *caddy.Replacer, img image.Image) (image.Image, error) {
+	width, height, err := f.size.Resolve(repl, img.Bounds())
+	if err != nil {
+		return img, err
 	}
 
 	// no upsizing
@@ -81,7 +85,26 @@ func (f *Resize) Apply(repl *caddy.Replacer, img image.Image) (image.Image, erro
 		return img, nil
 	}
 
-	return imaging.Resize(img, width, height, imaging.Linear), nil
+	// preserve the aspect ratio like imaging.Resize
+	srcWidth, srcHeight := img.Bounds().Dx(), img.Bounds().Dy()
+	if width == 0 {
+		width = max(int(math.Floor(float64(height)*float64(srcWidth)/float64(srcHeight)+0.5)), 1)
+	}
+	if height == 0 {
+		height = max(int(math.Floor(float64(width)*float64(srcHeight)/float64(srcWidth)+0.5)), 1)
+	}
+
+	resized := img
+	if width != srcWidth {
+		resized = imaging.Resize(img, width, srcHeight, imaging.Linear)
+		if err := ctx.Err(); err != nil {
+			return img, err
+		}
+	}
+	if height != srcHeight {
+		resized = imaging.Resize(resized, width, height, imaging.Linear)
+	}
+	return resized, nil
 }
 
 // CaddyModule returns the Caddy module information.
@@ -99,6 +122,8 @@ func init() {
 
 // Interface guards.
 var (
-	_ imagefilter.Filter    = (*Resize)(nil)
-	_ caddyfile.Unmarshaler = (*Resize)(nil)
+	_ imagefilter.Filter        = (*Resize)(nil)
+	_ imagefilter.ContextFilter = (*Resize)(nil)
+	_ caddyfile.Unmarshaler     = (*Resize)(nil)
+	_ caddy.Provisioner         = (*Resize)(nil)
 )
@@ -0,0 +1,72 @@
+package resize
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/disintegration/imaging"
+)
+
+// testImage returns an image with a gradient, so resampling changes the pixels.
+func testImage(width, height int) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x * 7), G: uint8(y * 5), B: uint8(x * y), A: 255})
+		}
+	}
+	return img
+}
+
+func TestResizeMatchesImaging(t *testing.T) {
+	src := testImage(40, 30)
+	for _, tc := range []struct {
+		width, height string
+		want          image.Image
+	}{
+		{width: "20", height: "15", want: imaging.Resize(src, 20, 15, imaging.Linear)},
+		{width: "20", height: "0", want: imaging.Resize(src, 20, 0, imaging.Linear)},
+		{width: "0", height: "7", want: imaging.Resize(src, 0, 7, imaging.Linear)},
+		{width: "40", height: "10", want: imaging.Resize(src, 40, 10, imaging.Linear)},
+		{width: "13", height: "30", want: imaging.Resize(src, 13, 30, imaging.Linear)},
+	} {
+		f := &Resize{Width: tc.width, Height: tc.height}
+		err := f.Provision(caddy.Context{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := f.ApplyContext(context.Background(), nil, caddy.NewReplacer(), src)
+		if err != nil {
+			t.Fatalf("%sx%s: %v", tc.width, tc.height, err)
+		}
+		if got.Bounds() != tc.want.Bounds() {
+			t.Errorf("%sx%s: bounds = %v, want %v", tc.width, tc.height, got.Bounds(), tc.want.Bounds())
+			continue
+		}
+		if !bytes.Equal(got.(*image.NRGBA).Pix, tc.want.(*image.NRGBA).Pix) {
+			t.Errorf("%sx%s: pixels differ from imaging.Resize", tc.width, tc.height)
+		}
+	}
+}
+
+func TestResizeCanceled(t *testing.T) {
+	f := &Resize{Width: "20", Height: "15"}
+	err := f.Provision(caddy.Context{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	src := testImage(40, 30)
+	got, err := f.ApplyContext(ctx, nil, caddy.NewReplacer(), src)
+	if err != context.Canceled {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+	if got != src {
+		t.Error("canceled resize didn't return the input image")
+	}
+}
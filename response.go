@@ -0,0 +1,158 @@
+package imagefilter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Possible values of ImageFilter.Source.
+const (
+	sourceFile     = "file"
+	sourceResponse = "response"
+	sourceOrigin   = "origin"
+	sourceUpload   = "upload"
+)
+
+// defaultMaxResponseSize is the default of ImageFilter.MaxResponseSize.
+const defaultMaxResponseSize = 32 << 20
+
+// imageTypes are the media types of responses that are filtered (see ImageFilter.Source).
+var imageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/bmp":  true,
+	"image/tiff": true,
+	"image/webp": true,
+}
+
+// responseHeaders are headers of the recorded response that don't apply to the filtered image.
+var responseHeaders = []string{"Content-Type", "Content-Length", "Etag", "Accept-Ranges"}
+
+// serveResponse records the response of the next handler and filters it, if it's an image.
+// Otherwise, or if the image can't be decoded, the response is passed through untouched.
+func (img *ImageFilter) serveResponse(w http.ResponseWriter, r *http.Request, repl *caddy.Replacer, next caddyhttp.Handler) error {
+	if r.Method != http.MethodGet {
+		return next.ServeHTTP(w, r)
+	}
+
+	shouldBuf := func(status int, header http.Header) bool {
+		if status != http.StatusOK || header.Get("Content-Encoding") != "" {
+			return false
+		}
+		mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+		if err != nil || !imageTypes[mediaType] {
+			return false
+		}
+		if cl := header.Get("Content-Length"); cl != "" {
+			size, err := strconv.ParseInt(cl, 10, 64)
+			return err == nil && size <= img.MaxResponseSize
+		}
+		return true
+	}
+
+	buf := new(bytes.Buffer)
+	rec := &limitedRecorder{
+		ResponseRecorder: caddyhttp.NewResponseRecorder(w, buf, shouldBuf),
+		w:                w,
+		limit:            img.MaxResponseSize,
+	}
+	err := next.ServeHTTP(rec, r)
+	if err != nil {
+		return err
+	}
+	if !rec.Buffered() || rec.passThrough {
+		return nil
+	}
+
+	imageFilterMetrics.inputBytes.Observe(float64(buf.Len()))
+
+	path := r.URL.Path
+	sum := sha256.Sum256(buf.Bytes())
+	img.setCacheKey(repl, path, hex.EncodeToString(sum[:]))
+	if img.SurrogateKeys {
+		setSurrogateKeys(w, path)
+	}
+
+	// the recorder shares the header with w
+	header := w.Header()
+	saved := make(map[string][]string, len(responseHeaders))
+	for _, name := range responseHeaders {
+		saved[name] = header.Values(name)
+		header.Del(name)
+	}
+	original := func() error {
+		for name, values := range saved {
+			for _, value := range values {
+				header.Add(name, value)
+			}
+		}
+		return rec.WriteResponse()
+	}
+
+	release, err := img.reserve(r.Context())
+	if err != nil {
+		return err
+	}
+	src := io.NopCloser(bytes.NewReader(buf.Bytes()))
+	err = img.process(w, r, repl, src, path, release, original)
+	var handlerErr caddyhttp.HandlerError
+	if errors.As(err, &handlerErr) && handlerErr.StatusCode == http.StatusUnsupportedMediaType {
+		// the image can't be decoded (e.g. it's truncated or the format is not supported), it's
+		// passed through like any other response
+		return original()
+	}
+	return err
+}
+
+// limitedRecorder stops buffering the response once it's larger than the limit. Then the buffered
+// part is written and the rest of the response is passed through. It's needed for responses
+// without Content-Length, which size is not known in advance.
+type limitedRecorder struct {
+	caddyhttp.ResponseRecorder
+	w           http.ResponseWriter
+	limit       int64
+	passThrough bool
+}
+
+func (lr *limitedRecorder) Write(p []byte) (int, error) {
+	if lr.passThrough {
+		return lr.w.Write(p)
+	}
+	lr.ResponseRecorder.WriteHeader(http.StatusOK)
+	if !lr.Buffered() || int64(lr.Buffer().Len()+len(p)) <= lr.limit {
+		return lr.ResponseRecorder.Write(p)
+	}
+
+	lr.passThrough = true
+	lr.w.WriteHeader(lr.Status())
+	_, err := lr.Buffer().WriteTo(lr.w)
+	if err != nil {
+		return 0, err
+	}
+	return lr.w.Write(p)
+}
+
+// ReadFrom hides the ReadFrom method of the recorder, which would read everything into the buffer.
+func (lr *limitedRecorder) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(writerOnly{lr}, r)
+}
+
+// Unwrap returns the underlying response writer for http.ResponseController.
+func (lr *limitedRecorder) Unwrap() http.ResponseWriter {
+	return lr.ResponseRecorder
+}
+
+// writerOnly hides all methods of the writer except Write.
+type writerOnly struct {
+	io.Writer
+}
@@ -0,0 +1,120 @@
+package imagefilter
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestServeResponseStreamsLargeResponses(t *testing.T) {
+	img := newTestImageFilter(testFilter{})
+	img.Timeout = caddy.Duration(time.Minute)
+	img.MaxResponseSize = 100
+	body := strings.Repeat("x", 250)
+
+	for _, useReadFrom := range []bool{false, true} {
+		w := httptest.NewRecorder()
+		var streamed int
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			// no Content-Length, so the size is not known in advance
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Etag", `"abc"`)
+			if useReadFrom {
+				_, err := io.Copy(w, strings.NewReader(body))
+				streamed = w.(*limitedRecorder).Buffer().Len()
+				return err
+			}
+			for i := 0; i < len(body); i += 50 {
+				_, err := w.Write([]byte(body[i : i+50]))
+				if err != nil {
+					return err
+				}
+			}
+			streamed = w.(*limitedRecorder).Buffer().Len()
+			return nil
+		})
+
+		repl := caddy.NewReplacer()
+		r := httptest.NewRequest(http.MethodGet, "/large.png", nil)
+		err := img.serveResponse(w, r, repl, next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Body.String() != body {
+			t.Errorf("ReadFrom %v: response body was changed (%d bytes)", useReadFrom, w.Body.Len())
+		}
+		if streamed != 0 {
+			t.Errorf("ReadFrom %v: %d bytes still buffered after the limit was exceeded", useReadFrom, streamed)
+		}
+		if got := w.Header().Get("Etag"); got != `"abc"` {
+			t.Errorf("ReadFrom %v: Etag = %q, want the original one", useReadFrom, got)
+		}
+	}
+}
+
+func TestServeResponseFiltersSmallResponses(t *testing.T) {
+	img := newTestImageFilter(testFilter{})
+	img.Timeout = caddy.Duration(time.Minute)
+	img.MaxResponseSize = 1 << 20
+	body := testPNG(t, 20, 10)
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "image/png")
+		_, err := io.Copy(w, bytes.NewReader(body))
+		return err
+	})
+	repl := caddy.NewReplacer()
+	r := httptest.NewRequest(http.MethodGet, "/small.png", nil)
+	w := httptest.NewRecorder()
+	err := img.serveResponse(w, r, repl, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := repl.Get("http.image_filter.output_width"); got != 20 {
+		t.Errorf("response was not filtered: output_width = %v, want 20", got)
+	}
+}
+
+func TestServeResponsePassesThroughUndecodableImages(t *testing.T) {
+	truncated := testPNG(t, 20, 10)
+	truncated = truncated[:len(truncated)/2]
+
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		img := newTestImageFilter(testFilter{})
+		img.Timeout = caddy.Duration(timeout)
+		img.MaxResponseSize = 1 << 20
+
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Etag", `"abc"`)
+			_, err := w.Write(truncated)
+			return err
+		})
+		repl := caddy.NewReplacer()
+		r := httptest.NewRequest(http.MethodGet, "/truncated.png", nil)
+		w := httptest.NewRecorder()
+		err := img.serveResponse(w, r, repl, next)
+		if err != nil {
+			t.Fatalf("timeout %v: %v", timeout, err)
+		}
+		if w.Code != http.StatusOK {
+			t.Errorf("timeout %v: status = %d, want %d", timeout, w.Code, http.StatusOK)
+		}
+		if !bytes.Equal(w.Body.Bytes(), truncated) {
+			t.Errorf("timeout %v: response body was changed (%d bytes)", timeout, w.Body.Len())
+		}
+		if got := w.Header().Get("Content-Type"); got != "image/png" {
+			t.Errorf("timeout %v: Content-Type = %q, want the original one", timeout, got)
+		}
+		if got := w.Header().Get("Etag"); got != `"abc"` {
+			t.Errorf("timeout %v: Etag = %q, want the original one", timeout, got)
+		}
+	}
+}
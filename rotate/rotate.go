@@ -1,20 +1,20 @@
 package rotate
 
 import (
-	"errors"
-	"fmt"
 	"image"
-	"strconv"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/disintegration/imaging"
 	imagefilter "github.com/ueffel/caddy-imagefilter/v2"
+	"github.com/ueffel/caddy-imagefilter/v2/params"
 )
 
 // Rotate rotates a image 90, 180 or 270 degrees counter-clockwise.
 type Rotate struct {
 	Angle string `json:"angle,omitempty"`
+
+	angle params.Angle
 }
 
 // UnmarshalCaddyfile configures the Rotate instance.
@@ -40,17 +40,21 @@ func (f *Rotate) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// Provision parses the arguments.
+func (f *Rotate) Provision(ctx caddy.Context) error {
+	var err error
+	f.angle, err = params.NewAngle("angle", f.Angle, params.OneOf(0.0, 90, 180, 270))
+	return err
+}
+
 // Apply applies the image filter to an image and returns the new image.
 func (f *Rotate) Apply(repl *caddy.Replacer, img image.Image) (image.Image, error) {
-	angleRepl := repl.ReplaceAll(f.Angle, "")
-	angle, err := strconv.Atoi(angleRepl)
+	angle, err := f.angle.Value(repl)
 	if err != nil {
-		return img, fmt.Errorf("invalid angle: %w", err)
+		return img, err
 	}
 
 	switch angle {
-	case 0:
-		return img, nil
 	case 90:
 		return imaging.Rotate90(img), nil
 	case 180:
@@ -58,7 +62,7 @@ func (f *Rotate) Apply(repl *caddy.Replacer, img image.Image) (image.Image, erro
 	case 270:
 		return imaging.Rotate270(img), nil
 	default:
-		return nil, errors.New("invalid angle (only 0, 90, 180, 270 allowed)")
+		return img, nil
 	}
 }
 
@@ -79,4 +83,5 @@ func init() {
 var (
 	_ imagefilter.Filter    = (*Rotate)(nil)
 	_ caddyfile.Unmarshaler = (*Rotate)(nil)
+	_ caddy.Provisioner     = (*Rotate)(nil)
 )
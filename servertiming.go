@@ -0,0 +1,50 @@
+package imagefilter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverTimingCtxKey is the context key of the *serverTiming of a request.
+type serverTimingCtxKey struct{}
+
+// serverTiming collects the durations of the processing steps of a request for the Server-Timing
+// response header.
+type serverTiming struct {
+	mu      sync.Mutex
+	metrics []timingMetric
+}
+
+// timingMetric is a single entry of the Server-Timing header.
+type timingMetric struct {
+	name string
+	dur  time.Duration
+}
+
+// recordTiming adds a duration to the server timing of the request, if it's enabled (see
+// ImageFilter.ServerTiming).
+func recordTiming(ctx context.Context, name string, dur time.Duration) {
+	st, ok := ctx.Value(serverTimingCtxKey{}).(*serverTiming)
+	if !ok {
+		return
+	}
+	st.mu.Lock()
+	st.metrics = append(st.metrics, timingMetric{name: name, dur: dur})
+	st.mu.Unlock()
+}
+
+// String formats the collected durations as value of the Server-Timing header, e.g.
+// "decode;dur=12.5, resize;dur=30.1, encode;dur=8.2".
+func (st *serverTiming) String() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	entries := make([]string, 0, len(st.metrics))
+	for _, m := range st.metrics {
+		entries = append(entries, fmt.Sprintf("%s;dur=%.1f", m.name, float64(m.dur.Microseconds())/1000))
+	}
+	return strings.Join(entries, ", ")
+}
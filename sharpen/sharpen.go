@@ -1,20 +1,20 @@
 package sharpen
 
 import (
-	"errors"
-	"fmt"
 	"image"
-	"strconv"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/disintegration/imaging"
 	imagefilter "github.com/ueffel/caddy-imagefilter/v2"
+	"github.com/ueffel/caddy-imagefilter/v2/params"
 )
 
 // Sharpen produces a sharpened version of the image.
 type Sharpen struct {
 	Sigma string `json:"sigma,omitempty"`
+
+	sigma params.Float
 }
 
 // UnmarshalCaddyfile configures the Sharpen instance.
@@ -38,22 +38,18 @@ func (f *Sharpen) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
-// Apply applies the image filter to an image and returns the new image.
-func (f *Sharpen) Apply(repl *caddy.Replacer, img image.Image) (image.Image, error) {
+// Provision parses the arguments.
+func (f *Sharpen) Provision(ctx caddy.Context) error {
 	var err error
-	var sigma float64
-	sigmaRepl := repl.ReplaceAll(f.Sigma, "")
-	if sigmaRepl == "" {
-		sigma = 1
-	} else {
-		sigma, err = strconv.ParseFloat(sigmaRepl, 64)
-		if err != nil {
-			return img, fmt.Errorf("invalid sigma: %w", err)
-		}
-	}
+	f.sigma, err = params.NewFloat("sigma", f.Sigma, 1, params.Greater(0.0))
+	return err
+}
 
-	if sigma <= 0 {
-		return img, errors.New("invalid sigma: cannot be less or equal 0")
+// Apply applies the image filter to an image and returns the new image.
+func (f *Sharpen) Apply(repl *caddy.Replacer, img image.Image) (image.Image, error) {
+	sigma, err := f.sigma.Value(repl)
+	if err != nil {
+		return img, err
 	}
 
 	return imaging.Sharpen(img, sigma), nil
@@ -76,4 +72,5 @@ func init() {
 var (
 	_ imagefilter.Filter    = (*Sharpen)(nil)
 	_ caddyfile.Unmarshaler = (*Sharpen)(nil)
+	_ caddy.Provisioner     = (*Sharpen)(nil)
 )
@@ -0,0 +1,181 @@
+package imagefilter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// defaultSidecarSuffix is the default of ImageFilter.Sidecar.
+const defaultSidecarSuffix = ".json"
+
+// maxSidecarSize is the maximum size of a sidecar file in bytes.
+const maxSidecarSize = 64 << 10
+
+// sidecarKey is the placeholder key of the sidecar of the source image.
+const sidecarKey = "image_filter.sidecar"
+
+// Sidecar is the metadata of a source image, that is read from a JSON file next to it (see
+// ImageFilter.Sidecar).
+type Sidecar struct {
+	// FocalPoint is the most important point of the image. Filters cropping the image keep it as
+	// close to the center as possible.
+	FocalPoint *FocalPoint `json:"focal_point,omitempty"`
+
+	// Crop is the manually selected region of the image in pixels of the source image. Filters
+	// cropping the image stay inside of it.
+	Crop *CropRect `json:"crop,omitempty"`
+
+	// Alt is the alternative text of the image.
+	Alt string `json:"alt,omitempty"`
+
+	// width and height are the size of the image the sidecar belongs to, if the source image is a
+	// high density variant of it (see HiDPI). Otherwise they are 0.
+	width, height int
+}
+
+// FocalPoint is a point relative to the size of the image, (0, 0) is top left and (1, 1) is
+// bottom right.
+type FocalPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// CropRect is a rectangle in pixels.
+type CropRect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// validate validates the sidecar.
+func (s *Sidecar) validate() error {
+	if fp := s.FocalPoint; fp != nil && (fp.X < 0 || fp.X > 1 || fp.Y < 0 || fp.Y > 1) {
+		return errors.New("focal_point must be between 0 and 1")
+	}
+	if c := s.Crop; c != nil && (c.X < 0 || c.Y < 0 || c.Width <= 0 || c.Height <= 0) {
+		return errors.New("crop must have a positive size and position")
+	}
+	return nil
+}
+
+// readSidecar reads the sidecar of the source file and sets its placeholders. Missing sidecars
+// are ignored, invalid ones are logged and ignored. It returns the sidecar or nil and its identity
+// for the cache key.
+func (img *ImageFilter) readSidecar(repl *caddy.Replacer, filename string) (*Sidecar, string) {
+	sidecarFilename := filename + img.Sidecar
+	file, err := img.fileSystem.Open(sidecarFilename)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			img.logger.Warn("failed to open sidecar", zap.String("file", sidecarFilename), zap.Error(err))
+		}
+		return nil, ""
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxSidecarSize+1))
+	if err == nil && len(data) > maxSidecarSize {
+		err = fmt.Errorf("larger than %d bytes", maxSidecarSize)
+	}
+	sidecar := new(Sidecar)
+	if err == nil {
+		err = json.Unmarshal(data, sidecar)
+	}
+	if err == nil {
+		err = sidecar.validate()
+	}
+	if err != nil {
+		img.logger.Warn("invalid sidecar", zap.String("file", sidecarFilename), zap.Error(err))
+		return nil, ""
+	}
+
+	repl.Set(sidecarKey, sidecar)
+	if sidecar.FocalPoint != nil {
+		repl.Set("http.image_filter.focal_x", strconv.FormatFloat(sidecar.FocalPoint.X, 'f', -1, 64))
+		repl.Set("http.image_filter.focal_y", strconv.FormatFloat(sidecar.FocalPoint.Y, 'f', -1, 64))
+	}
+	if sidecar.Crop != nil {
+		repl.Set("http.image_filter.crop_x", sidecar.Crop.X)
+		repl.Set("http.image_filter.crop_y", sidecar.Crop.Y)
+		repl.Set("http.image_filter.crop_width", sidecar.Crop.Width)
+		repl.Set("http.image_filter.crop_height", sidecar.Crop.Height)
+	}
+	if sidecar.Alt != "" {
+		repl.Set("http.image_filter.alt", sidecar.Alt)
+	}
+	return sidecar, string(data)
+}
+
+// CropHints returns the manually selected region and the focal point of the source image from its
+// sidecar, scaled to the bounds of the current image. The region is the whole image if there is no
+// manual crop, and the focal point is the center of the region if there is none. ok is false if
+// the sidecar has neither. Filters cropping the image use them as defaults.
+//
+// The hints follow preceding filters, that scale the image, but not ones that crop, flip or rotate
+// it. If the orientation changed from landscape to portrait or vice versa (e.g. by rotating by 90
+// degrees), the hints are ignored and ok is false. Other changes are not detected.
+func CropHints(repl *caddy.Replacer, bounds image.Rectangle) (region image.Rectangle, focal image.Point, ok bool) {
+	value, _ := repl.Get(sidecarKey)
+	sidecar, _ := value.(*Sidecar)
+	if sidecar == nil || (sidecar.FocalPoint == nil && sidecar.Crop == nil) {
+		return bounds, image.Point{}, false
+	}
+
+	// the hints refer to the image the sidecar belongs to, which may have been resized by
+	// preceding filters or is a high density variant
+	width, height := sidecar.width, sidecar.height
+	if width <= 0 || height <= 0 {
+		sourceWidth, _ := repl.Get("image_filter.source_width")
+		sourceHeight, _ := repl.Get("image_filter.source_height")
+		width, _ = sourceWidth.(int)
+		height, _ = sourceHeight.(int)
+	}
+	scaleX, scaleY := 1.0, 1.0
+	if width > 0 && height > 0 {
+		if (width > height && bounds.Dx() < bounds.Dy()) || (width < height && bounds.Dx() > bounds.Dy()) {
+			return bounds, image.Point{}, false
+		}
+		scaleX = float64(bounds.Dx()) / float64(width)
+		scaleY = float64(bounds.Dy()) / float64(height)
+	}
+
+	region = bounds
+	if c := sidecar.Crop; c != nil {
+		region = image.Rect(
+			int(float64(c.X)*scaleX),
+			int(float64(c.Y)*scaleY),
+			int(float64(c.X+c.Width)*scaleX),
+			int(float64(c.Y+c.Height)*scaleY),
+		).Add(bounds.Min).Intersect(bounds)
+		if region.Empty() {
+			region = bounds
+		}
+	}
+
+	focal = image.Pt(region.Min.X+region.Dx()/2, region.Min.Y+region.Dy()/2)
+	if fp := sidecar.FocalPoint; fp != nil {
+		focal = image.Pt(
+			bounds.Min.X+int(fp.X*float64(bounds.Dx())),
+			bounds.Min.Y+int(fp.Y*float64(bounds.Dy())),
+		)
+	}
+	return region, focal, true
+}
+
+// FocusRect returns a rectangle of the size inside of the region, that is centered on the focal
+// point as close as possible. The size is reduced to fit into the region.
+func FocusRect(region image.Rectangle, focal image.Point, width, height int) image.Rectangle {
+	width = min(width, region.Dx())
+	height = min(height, region.Dy())
+	x := min(max(focal.X-width/2, region.Min.X), region.Max.X-width)
+	y := min(max(focal.Y-height/2, region.Min.Y), region.Max.Y-height)
+	return image.Rect(x, y, x+width, y+height)
+}
@@ -0,0 +1,98 @@
+package imagefilter
+
+import (
+	"context"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// hintsFilter is an image filter for tests, that records the crop hints.
+type hintsFilter struct {
+	region *image.Rectangle
+}
+
+func (hintsFilter) UnmarshalCaddyfile(*caddyfile.Dispenser) error { return nil }
+
+func (f hintsFilter) ApplyContext(_ context.Context, _ *http.Request, repl *caddy.Replacer, img image.Image) (image.Image, error) {
+	*f.region, _, _ = CropHints(repl, img.Bounds())
+	return img, nil
+}
+
+func TestCropHints(t *testing.T) {
+	sidecar := &Sidecar{Crop: &CropRect{X: 10, Y: 20, Width: 40, Height: 20}}
+	for _, tc := range []struct {
+		name   string
+		width  int // of the image the sidecar belongs to, 0 for the source image
+		bounds image.Rectangle
+		want   image.Rectangle
+		wantOK bool
+	}{
+		{name: "source", bounds: image.Rect(0, 0, 100, 50), want: image.Rect(10, 20, 50, 40), wantOK: true},
+		{name: "resized", bounds: image.Rect(0, 0, 50, 25), want: image.Rect(5, 10, 25, 20), wantOK: true},
+		{name: "variant", width: 50, bounds: image.Rect(0, 0, 100, 50), want: image.Rect(20, 40, 100, 50), wantOK: true},
+		{name: "rotated", bounds: image.Rect(0, 0, 50, 100), want: image.Rect(0, 0, 50, 100)},
+	} {
+		sidecar.width, sidecar.height = tc.width, tc.width/2
+		repl := caddy.NewReplacer()
+		repl.Set(sidecarKey, sidecar)
+		repl.Set("image_filter.source_width", 100)
+		repl.Set("image_filter.source_height", 50)
+
+		region, _, ok := CropHints(repl, tc.bounds)
+		if region != tc.want || ok != tc.wantOK {
+			t.Errorf("%s: CropHints = %v, %v, want %v, %v", tc.name, region, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+func TestSidecarOfHiDPIVariant(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string][]byte{
+		"hero.png":      testPNG(t, 100, 50),
+		"hero@2x.png":   testPNG(t, 200, 100),
+		"hero.png.json": []byte(`{"crop": {"x": 10, "y": 5, "width": 50, "height": 25}}`),
+		// must not be used
+		"hero@2x.png.json": []byte(`{"crop": {"x": 0, "y": 0, "width": 10, "height": 10}}`),
+	} {
+		err := os.WriteFile(filepath.Join(root, name), content, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var region image.Rectangle
+	img := newTestImageFilter(hintsFilter{region: &region})
+	img.Timeout = caddy.Duration(time.Minute)
+	img.Root = root
+	img.fileSystem = osFS{}
+	img.Sidecar = defaultSidecarSuffix
+	img.HiDPI = &HiDPI{Width: "200"}
+	img.HiDPI.provision()
+
+	repl := caddy.NewReplacer()
+	r := httptest.NewRequest(http.MethodGet, "/hero.png", nil)
+	r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+	w := httptest.NewRecorder()
+	err := img.ServeHTTP(w, r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := repl.Get("http.image_filter.source_width"); got != 200 {
+		t.Fatalf("source_width = %v, the high density variant was not selected", got)
+	}
+	if got, _ := repl.Get("http.image_filter.crop_width"); got != 50 {
+		t.Errorf("crop_width = %v, want the sidecar of the requested file", got)
+	}
+	if want := image.Rect(20, 10, 120, 60); region != want {
+		t.Errorf("crop region = %v, want %v in pixels of the variant", region, want)
+	}
+}
@@ -1,9 +1,10 @@
 package smartcrop
 
 import (
+	"context"
 	"fmt"
 	"image"
-	"strconv"
+	"net/http"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -12,6 +13,7 @@ import (
 	"github.com/muesli/smartcrop/nfnt"
 	"github.com/nfnt/resize"
 	imagefilter "github.com/ueffel/caddy-imagefilter/v2"
+	"github.com/ueffel/caddy-imagefilter/v2/params"
 )
 
 // Smartcrop finds good rectangular image crops of a specific size.
@@ -19,6 +21,8 @@ import (
 type Smartcrop struct {
 	Width  string `json:"width,omitempty"`
 	Height string `json:"height,omitempty"`
+
+	size params.Size
 }
 
 // UnmarshalCaddyfile configures the Smartcrop instance.
@@ -26,14 +30,24 @@ type Smartcrop struct {
 // Syntax:
 //
 //	smartcrop <width> <height>
+//	smartcrop <aspect ratio>
 //
 // Parameters:
 //
 // width must be a positive integer and determines the width of the cropped image.
 //
 // height must be a positive integer and determines the height of the cropped image.
+//
+// Width and height can also be percentages of the image size like 50%.
+//
+// aspect ratio in the form <w>:<h> (e.g. 16:9) finds the best region with this aspect ratio and
+// the largest possible size.
+//
+// If the image's sidecar has a focal point or manual crop region (see imagefilter.CropHints), the
+// largest region inside of the manual crop region, that is centered on the focal point, is used
+// instead of analyzing the image.
 func (f *Smartcrop) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	if d.CountRemainingArgs() < 2 {
+	if d.CountRemainingArgs() < 1 {
 		return imagefilter.ErrTooFewArgs
 	}
 	if d.CountRemainingArgs() > 2 {
@@ -42,29 +56,45 @@ func (f *Smartcrop) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 	args := d.RemainingArgs()
 	f.Width = args[0]
-	f.Height = args[1]
+	if len(args) > 1 {
+		f.Height = args[1]
+	}
 
 	return nil
 }
 
+// Provision parses the arguments.
+func (f *Smartcrop) Provision(ctx caddy.Context) error {
+	var err error
+	f.size, err = params.NewSize(f.Width, f.Height, params.SizeOptions{AspectRatio: true})
+	return err
+}
+
 // Apply applies the image filter to an image and returns the new image.
 func (f *Smartcrop) Apply(repl *caddy.Replacer, img image.Image) (image.Image, error) {
-	widthRepl := repl.ReplaceAll(f.Width, "")
-	width, err := strconv.Atoi(widthRepl)
-	if err != nil {
-		return img, fmt.Errorf("invalid width %s %w", widthRepl, err)
-	}
-	if width <= 0 {
-		return nil, fmt.Errorf("invalid width %d", width)
+	return f.ApplyContext(context.Background(), nil, repl, img)
+}
+
+// ApplyContext applies the image filter to an image and returns the new image. It stops, if the
+// context is done after the analysis, before the found region is cropped and resized.
+func (f *Smartcrop) ApplyContext(ctx context.Context, _ *http.Request, repl *caddy.Replacer, img image.Image) (image.Image, error) {
+	if region, focal, ok := imagefilter.CropHints(repl, img.Bounds()); ok {
+		width, height, err := f.size.Resolve(repl, region)
+		if err != nil {
+			return img, err
+		}
+		// largest region with the aspect ratio of the requested size
+		cropWidth, cropHeight := region.Dx(), max(region.Dx()*height/width, 1)
+		if cropHeight > region.Dy() {
+			cropWidth, cropHeight = max(region.Dy()*width/height, 1), region.Dy()
+		}
+		cropped := imaging.Crop(img, imagefilter.FocusRect(region, focal, cropWidth, cropHeight))
+		return imaging.Resize(cropped, width, height, imaging.Linear), nil
 	}
 
-	heightRepl := repl.ReplaceAll(f.Height, "")
-	height, err := strconv.Atoi(heightRepl)
+	width, height, err := f.size.Resolve(repl, img.Bounds())
 	if err != nil {
-		return img, fmt.Errorf("invalid height %s %w", heightRepl, err)
-	}
-	if height <= 0 {
-		return img, fmt.Errorf("invalid height %d", height)
+		return img, err
 	}
 
 	analyzer := smartcrop.NewAnalyzer(nfnt.NewResizer(resize.Bilinear))
@@ -72,6 +102,9 @@ func (f *Smartcrop) Apply(repl *caddy.Replacer, img image.Image) (image.Image, e
 	if err != nil {
 		return img, fmt.Errorf("determining smartcrop %w", err)
 	}
+	if err := ctx.Err(); err != nil {
+		return img, err
+	}
 
 	cropped := imaging.Crop(img, topCrop)
 	return imaging.Resize(cropped, width, height, imaging.Linear), nil
@@ -92,6 +125,8 @@ func init() {
 
 // Interface guards.
 var (
-	_ imagefilter.Filter    = (*Smartcrop)(nil)
-	_ caddyfile.Unmarshaler = (*Smartcrop)(nil)
+	_ imagefilter.Filter        = (*Smartcrop)(nil)
+	_ imagefilter.ContextFilter = (*Smartcrop)(nil)
+	_ caddyfile.Unmarshaler     = (*Smartcrop)(nil)
+	_ caddy.Provisioner         = (*Smartcrop)(nil)
 )
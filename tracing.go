@@ -0,0 +1,64 @@
+package imagefilter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the spans created by the image filter.
+const tracerName = "github.com/ueffel/caddy-imagefilter/v2"
+
+// startSpan starts a child span of the span in ctx. The tracer is taken from the tracer provider
+// of that span, so spans are only recorded if caddy's tracing handler is enabled for the request.
+// Otherwise the returned span is a no-op.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records the error (if any) and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// filterAttributes returns the span attributes of a filter: its name and its arguments with
+// placeholders replaced. The arguments are only resolved if the span is recording.
+func filterAttributes(span trace.Span, filter ContextFilter, repl *caddy.Replacer) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{attribute.String("image_filter.filter", filterName(filter))}
+	if !span.IsRecording() {
+		return attrs
+	}
+
+	var mod any = filter
+	if fa, ok := filter.(filterAdapter); ok {
+		mod = fa.Filter
+	}
+	raw, err := json.Marshal(mod)
+	if err != nil {
+		return attrs
+	}
+	var args map[string]any
+	if json.Unmarshal(raw, &args) != nil {
+		return attrs
+	}
+
+	for key, value := range args {
+		switch v := value.(type) {
+		case string:
+			attrs = append(attrs, attribute.String("image_filter.arg."+key, repl.ReplaceAll(v, "")))
+		case float64, bool:
+			attrs = append(attrs, attribute.String("image_filter.arg."+key, fmt.Sprint(v)))
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,91 @@
+package imagefilter
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestProcessSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer func() { _ = provider.Shutdown(context.Background()) }()
+
+	img := newTestImageFilter(testFilter{})
+	img.Timeout = caddy.Duration(time.Minute)
+
+	ctx, root := provider.Tracer("test").Start(context.Background(), "request")
+	repl := caddy.NewReplacer()
+	r := httptest.NewRequest(http.MethodGet, "/test.png", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	src := io.NopCloser(bytes.NewReader(testPNG(t, 20, 10)))
+
+	err := img.process(w, r, repl, src, "test.png", func() {}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.End()
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	requestSpan, ok := spans["request"]
+	if !ok {
+		t.Fatal("request span was not exported")
+	}
+
+	for name, want := range map[string][]attribute.KeyValue{
+		"image.Decode": {
+			attribute.String("image_filter.format", "png"),
+			attribute.Int("image_filter.width", 20),
+			attribute.Int("image_filter.height", 10),
+		},
+		"Filter.Apply": {
+			attribute.String("image_filter.filter", "unknown"),
+		},
+		"imaging.Encode": {
+			attribute.String("image_filter.format", "png"),
+		},
+	} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("span %s was not exported", name)
+			continue
+		}
+		if span.Parent.SpanID() != requestSpan.SpanContext.SpanID() {
+			t.Errorf("span %s is not a child of the request span", name)
+		}
+		if span.SpanContext.TraceID() != requestSpan.SpanContext.TraceID() {
+			t.Errorf("span %s is not part of the request's trace", name)
+		}
+		attrs := map[attribute.Key]attribute.Value{}
+		for _, attr := range span.Attributes {
+			attrs[attr.Key] = attr.Value
+		}
+		for _, attr := range want {
+			if got, ok := attrs[attr.Key]; !ok || got != attr.Value {
+				t.Errorf("span %s: attribute %s = %v, want %v", name, attr.Key, got.Emit(), attr.Value.Emit())
+			}
+		}
+	}
+
+	if encode, ok := spans["imaging.Encode"]; ok {
+		found := false
+		for _, attr := range encode.Attributes {
+			found = found || (attr.Key == "image_filter.bytes" && attr.Value.AsInt64() > 0)
+		}
+		if !found {
+			t.Error("span imaging.Encode has no image_filter.bytes")
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package imagefilter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
+)
+
+// Defaults of Upload.
+const (
+	defaultUploadMaxSize   = 32 << 20
+	defaultUploadMaxPixels = 50_000_000
+)
+
+// Upload configures filtering of images uploaded with POST requests (see ImageFilter.Source).
+// The body is either the raw image or multipart/form-data containing the image.
+type Upload struct {
+	// MaxSize is the maximum size of the request body in bytes. Default is 32 MiB.
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// MaxPixels is the maximum number of pixels (width * height) of an uploaded image. It's
+	// checked before the image is decoded completely. Default is 50 million.
+	MaxPixels int64 `json:"max_pixels,omitempty"`
+
+	// Field is the name of the form field containing the image in multipart/form-data requests.
+	// Default is the first field with a file.
+	Field string `json:"field,omitempty"`
+}
+
+// unmarshalUpload parses the accept_upload subdirective.
+//
+// Syntax:
+//
+//	accept_upload {
+//	    max_size   <size>
+//	    max_pixels <pixels>
+//	    field      <name>
+//	}
+func unmarshalUpload(d *caddyfile.Dispenser) (*Upload, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	u := new(Upload)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "max_size":
+			var sizeStr string
+			if !d.AllArgs(&sizeStr) {
+				return nil, d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(sizeStr)
+			if err != nil {
+				return nil, d.Errf("invalid max_size: %v", err)
+			}
+			u.MaxSize = int64(size)
+
+		case "max_pixels":
+			var pixelsStr string
+			if !d.AllArgs(&pixelsStr) {
+				return nil, d.ArgErr()
+			}
+			pixels, err := strconv.ParseInt(pixelsStr, 10, 64)
+			if err != nil {
+				return nil, d.Errf("invalid max_pixels: %v", err)
+			}
+			u.MaxPixels = pixels
+
+		case "field":
+			if !d.AllArgs(&u.Field) {
+				return nil, d.ArgErr()
+			}
+
+		default:
+			return nil, d.Errf("unrecognized accept_upload subdirective '%s'", d.Val())
+		}
+	}
+	return u, nil
+}
+
+// provision sets the defaults.
+func (u *Upload) provision() {
+	if u.MaxSize == 0 {
+		u.MaxSize = defaultUploadMaxSize
+	}
+	if u.MaxPixels == 0 {
+		u.MaxPixels = defaultUploadMaxPixels
+	}
+}
+
+// validate validates the configuration.
+func (u *Upload) validate() error {
+	if u.MaxSize < 0 || u.MaxPixels < 0 {
+		return errors.New("accept_upload max_size and max_pixels must be greater or equal 0")
+	}
+	return nil
+}
+
+// read returns the uploaded image from the request body.
+func (u *Upload) read(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, u.MaxSize)
+
+	var src io.Reader = r.Body
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			return nil, caddyhttp.Error(http.StatusBadRequest, err)
+		}
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil, caddyhttp.Error(http.StatusBadRequest, errors.New("no image in form data"))
+			}
+			if err != nil {
+				return nil, uploadError(err)
+			}
+			if (u.Field == "" && part.FileName() != "") || (u.Field != "" && part.FormName() == u.Field) {
+				src = part
+				break
+			}
+		}
+	}
+
+	body, err := io.ReadAll(src)
+	if err != nil {
+		return nil, uploadError(err)
+	}
+	return body, nil
+}
+
+// uploadError returns an error with status 413 if the body is too large, and 400 otherwise.
+func uploadError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge, err)
+	}
+	return caddyhttp.Error(http.StatusBadRequest, err)
+}
+
+// serveUpload filters the image uploaded with a POST request.
+func (img *ImageFilter) serveUpload(w http.ResponseWriter, r *http.Request, repl *caddy.Replacer) error {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+
+	body, err := img.Upload.read(w, r)
+	if err != nil {
+		return err
+	}
+	imageFilterMetrics.inputBytes.Observe(float64(len(body)))
+
+	cfg, formatName, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		imageFilterMetrics.errors.WithLabelValues(errorKindDecode).Inc()
+		return caddyhttp.Error(http.StatusUnsupportedMediaType, err)
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > img.Upload.MaxPixels {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge,
+			fmt.Errorf("image too large: %dx%d pixels", cfg.Width, cfg.Height))
+	}
+
+	sum := sha256.Sum256(body)
+	img.setCacheKey(repl, r.URL.Path, hex.EncodeToString(sum[:]))
+
+	release, err := img.reserve(r.Context())
+	if err != nil {
+		return err
+	}
+	src := io.NopCloser(bytes.NewReader(body))
+	return img.process(w, r, repl, src, "upload", release, func() error {
+		setContentType(w, formatName)
+		_, err := w.Write(body)
+		if err != nil {
+			img.logger.Error("failed to write image", zap.Error(err))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,284 @@
+package imagefilter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// variantName restricts variant names, because they are used as file names.
+var variantName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// variantsSourceFile is the name of the file in a directory of VariantsDir, that contains the
+// source of the outputs. Variant names can't contain dots, so it doesn't collide with an output.
+const variantsSourceFile = ".source"
+
+// Variant is a named pipeline of image filters, that produces one output of a variants request
+// (see ImageFilter.Variants).
+type Variant struct {
+	// Name of the variant. It may contain letters, digits, "-" and "_".
+	Name string `json:"name,omitempty"`
+
+	// Pipeline is the ordered list of image filters of this variant. They are applied to the
+	// result of the handler's pipeline.
+	PipelineRaw []json.RawMessage `json:"pipeline,omitempty" caddy:"namespace=http.handlers.image_filter.filter inline_key=filter"`
+
+	filters  []ContextFilter
+	pipeline []json.RawMessage
+}
+
+// manifest is the response of a variants request.
+type manifest struct {
+	Width    int               `json:"width"`
+	Height   int               `json:"height"`
+	Format   string            `json:"format"`
+	Variants []variantManifest `json:"variants"`
+}
+
+// variantManifest describes one output of a variants request.
+type variantManifest struct {
+	Name   string `json:"name"`
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Size   int    `json:"size"`
+	Data   []byte `json:"data,omitempty"`
+	Path   string `json:"path,omitempty"`
+}
+
+// unmarshalVariants parses the variants subdirective.
+//
+// Syntax:
+//
+//	variants [<dir>] {
+//	    <name> {
+//	        <filters...> <filter-args...>
+//	    }
+//	}
+func unmarshalVariants(d *caddyfile.Dispenser) ([]Variant, string, error) {
+	var dir string
+	args := d.RemainingArgs()
+	if len(args) > 1 {
+		return nil, "", d.ArgErr()
+	}
+	if len(args) == 1 {
+		dir = args[0]
+	}
+
+	var variants []Variant
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		v := Variant{Name: d.Val()}
+		if d.NextArg() {
+			return nil, "", d.ArgErr()
+		}
+		for variantNesting := d.Nesting(); d.NextBlock(variantNesting); {
+			filter, err := UnmarshalFilter(d)
+			if err != nil {
+				return nil, "", err
+			}
+			v.PipelineRaw = append(v.PipelineRaw, filter)
+		}
+		variants = append(variants, v)
+	}
+	return variants, dir, nil
+}
+
+// provisionVariants loads the image filters of the variants and makes VariantsDir absolute.
+func (img *ImageFilter) provisionVariants(ctx caddy.Context) error {
+	if img.VariantsDir != "" && !HasPlaceholder(img.VariantsDir) {
+		dir, err := filepath.Abs(img.VariantsDir)
+		if err != nil {
+			return fmt.Errorf("variants_dir: %v", err)
+		}
+		img.VariantsDir = dir
+	}
+
+	for i := range img.Variants {
+		v := &img.Variants[i]
+		v.pipeline = append([]json.RawMessage(nil), v.PipelineRaw...)
+		if len(v.PipelineRaw) == 0 {
+			continue
+		}
+		filters, err := LoadPipeline(ctx, v, "PipelineRaw")
+		if err != nil {
+			return fmt.Errorf("variant '%s': %v", v.Name, err)
+		}
+		v.filters = filters
+	}
+	return nil
+}
+
+// validateVariants validates the configuration of the variants.
+func (img *ImageFilter) validateVariants() error {
+	names := make(map[string]bool, len(img.Variants))
+	for _, v := range img.Variants {
+		if !variantName.MatchString(v.Name) {
+			return fmt.Errorf("invalid variant name '%s'", v.Name)
+		}
+		if names[v.Name] {
+			return fmt.Errorf("duplicate variant name '%s'", v.Name)
+		}
+		names[v.Name] = true
+	}
+	if img.VariantsDir != "" && len(img.Variants) == 0 {
+		return errors.New("variants_dir requires variants")
+	}
+	if HasPlaceholder(img.VariantsDir) {
+		return errors.New("variants_dir must not contain placeholders")
+	}
+	return nil
+}
+
+// variants applies the pipeline of each variant to the image and returns the JSON manifest of the
+// encoded outputs. The outputs are either contained in the manifest or written to VariantsDir.
+func (img *ImageFilter) variants(ctx context.Context, r *http.Request, repl *caddy.Replacer, reqImg image.Image, formatName string) ([]byte, error) {
+	var dir string
+	if img.VariantsDir != "" {
+		key, _ := repl.GetString("http.image_filter.cache_key")
+		var err error
+		dir, err = variantsDir(img.VariantsDir, key)
+		if err != nil {
+			return nil, err
+		}
+		err = os.MkdirAll(dir, 0o755)
+		if err != nil {
+			return nil, err
+		}
+		// the directory is named by the cache key, the source is recorded for purging by prefix
+		source, _ := repl.GetString(sourceKey)
+		err = writeVariant(filepath.Join(dir, variantsSourceFile), []byte(source))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m := manifest{
+		Width:    reqImg.Bounds().Dx(),
+		Height:   reqImg.Bounds().Dy(),
+		Format:   formatName,
+		Variants: make([]variantManifest, 0, len(img.Variants)),
+	}
+	for _, v := range img.Variants {
+		// every variant starts with the same image
+		setDimensionPlaceholders(repl, reqImg)
+		out, err := ApplyFilters(ctx, r, repl, v.filters, reqImg, img.logger)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := new(bytes.Buffer)
+		err = img.encode(ctx, buf, out, formatName)
+		if err != nil {
+			return nil, fmt.Errorf("variant '%s': %w", v.Name, err)
+		}
+
+		vm := variantManifest{
+			Name:   v.Name,
+			Format: formatName,
+			Width:  out.Bounds().Dx(),
+			Height: out.Bounds().Dy(),
+			Size:   buf.Len(),
+		}
+		if dir != "" {
+			vm.Path = filepath.Join(dir, v.Name+"."+formatName)
+			err = writeVariant(vm.Path, buf.Bytes())
+			if err != nil {
+				return nil, fmt.Errorf("variant '%s': %w", v.Name, err)
+			}
+		} else {
+			vm.Data = buf.Bytes()
+		}
+		m.Variants = append(m.Variants, vm)
+	}
+
+	return json.Marshal(m)
+}
+
+// cacheKeyName matches the directories of VariantsDir.
+var cacheKeyName = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// purgeVariants removes the outputs written to VariantsDir, whose source starts with the prefix
+// (see matchSourcePrefix), and returns the number of removed directories. Only directories named
+// like cache keys are removed. With a prefix, directories without a recorded source are kept.
+func (img *ImageFilter) purgeVariants(prefix string) (int, error) {
+	if img.VariantsDir == "" {
+		return 0, nil
+	}
+	entries, err := os.ReadDir(img.VariantsDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, entry := range entries {
+		if !entry.IsDir() || !cacheKeyName.MatchString(entry.Name()) {
+			continue
+		}
+		dir := filepath.Join(img.VariantsDir, entry.Name())
+		if prefix != "" {
+			source, err := os.ReadFile(filepath.Join(dir, variantsSourceFile))
+			if err != nil || !matchSourcePrefix(string(source), prefix) {
+				continue
+			}
+		}
+		err = os.RemoveAll(dir)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// variantsDir returns the directory of the outputs for the cache key inside of the base directory.
+func variantsDir(base, key string) (string, error) {
+	if key == "" || strings.ContainsAny(key, `/\.`) {
+		return "", fmt.Errorf("invalid cache key '%s' for variants_dir", key)
+	}
+	dir := filepath.Join(base, key)
+	rel, err := filepath.Rel(base, dir)
+	if err != nil || rel != key {
+		return "", fmt.Errorf("variants directory '%s' outside of '%s'", dir, base)
+	}
+	return dir, nil
+}
+
+// writeVariant writes the output of a variant, if the file doesn't exist yet. The file name
+// contains the cache key, so an existing file has the same content. The output is written to a
+// temporary file first, so concurrent requests never see a partially written file.
+func writeVariant(path string, data []byte) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".variant-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,56 @@
+package imagefilter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVariantsDir(t *testing.T) {
+	base := t.TempDir()
+	for _, tc := range []struct {
+		key     string
+		wantErr bool
+	}{
+		{key: "0123abcd"},
+		{key: "", wantErr: true},
+		{key: "..", wantErr: true},
+		{key: "../etc", wantErr: true},
+		{key: "a/b", wantErr: true},
+		{key: `a\b`, wantErr: true},
+	} {
+		dir, err := variantsDir(base, tc.key)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("variantsDir(%q) = %q, expected error", tc.key, dir)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("variantsDir(%q): %v", tc.key, err)
+			continue
+		}
+		if want := filepath.Join(base, tc.key); dir != want {
+			t.Errorf("variantsDir(%q) = %q, want %q", tc.key, dir, want)
+		}
+	}
+}
+
+func TestWriteVariantKeepsExisting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "small.png")
+	err := writeVariant(path, []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeVariant(path, []byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "first" {
+		t.Errorf("content = %q, want %q", data, "first")
+	}
+}